@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// accessPolicy decides who may sign in once the provider has identified
+// them. A user is allowed if they match any configured rule; with no rules
+// configured everyone is allowed.
+type accessPolicy struct {
+	Domains []string      // allowed email domains
+	Users   []string      // allowed user IDs or emails
+	Teams   []string      // Heroku teams whose members are allowed
+	Recheck time.Duration // how often long lived sessions are re-evaluated
+}
+
+var accessRules = loadAccessPolicy()
+
+func loadAccessPolicy() accessPolicy {
+	split := func(key string) []string {
+		return strings.Fields(strings.Replace(strings.ToLower(getenv(key)), ",", " ", -1))
+	}
+	p := accessPolicy{
+		Domains: split("ALLOWED_EMAIL_DOMAINS"),
+		Users:   split("ALLOWED_USERS"),
+		Teams:   split("ALLOWED_TEAMS"),
+		Recheck: time.Hour,
+	}
+	if d, err := time.ParseDuration(getenv("ACCESS_RECHECK_INTERVAL")); err == nil {
+		p.Recheck = d
+	}
+	return p
+}
+
+func (p accessPolicy) enabled() bool {
+	return len(p.Domains) > 0 || len(p.Users) > 0 || len(p.Teams) > 0
+}
+
+// due reports whether a's access should be evaluated again.
+func (p accessPolicy) due(a *account, now time.Time) bool {
+	return p.enabled() && now.Sub(a.CheckedAt) >= p.Recheck
+}
+
+var errAccessDenied = errors.New("access denied")
+
+// check returns nil if a may use the app, or an error wrapping
+// errAccessDenied that explains why not. client must be authorized as a.
+func (p accessPolicy) check(client *http.Client, a *account) error {
+	if !p.enabled() {
+		return nil
+	}
+	// An unverified email could belong to anyone, so only the ID counts.
+	var email string
+	if a.Identity.Verified {
+		email = strings.ToLower(a.Identity.Email)
+	}
+	for _, u := range p.Users {
+		if u == strings.ToLower(a.Identity.ID) || u == email {
+			return nil
+		}
+	}
+	if i := strings.LastIndex(email, "@"); i >= 0 {
+		for _, d := range p.Domains {
+			if email[i+1:] == d {
+				return nil
+			}
+		}
+	}
+	if len(p.Teams) > 0 && a.Provider == "heroku" {
+		teams, err := userTeams(client)
+		if err != nil {
+			return fmt.Errorf("checking team membership: %v", err)
+		}
+		for _, t := range teams {
+			for _, allowed := range p.Teams {
+				if strings.ToLower(t.Name) == allowed {
+					return nil
+				}
+			}
+		}
+	}
+	return fmt.Errorf("%w: %s is not on the allowlist, in an allowed email domain or a member of an allowed team", errAccessDenied, a.label())
+}
+
+// recheckAccess evaluates a again, recording when it last passed.
+func recheckAccess(ctx context.Context, a *account) error {
+	client, err := a.client(ctx)
+	if err != nil {
+		return err
+	}
+	if err := accessRules.check(client, a); err != nil {
+		return err
+	}
+	a.CheckedAt = time.Now()
+	a.changed = true
+	return nil
+}
+
+// denyAccess logs the rejection of a and renders the 403 page, or a 503 if
+// err is a failure to check access rather than a refusal.
+func denyAccess(w http.ResponseWriter, a *account, err error) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if !errors.Is(err, errAccessDenied) {
+		log.Printf("could not check access for %s %s (%s): %v", a.Provider, a.Identity.ID, a.Identity.Email, err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, `<html><body><h1>Couldn't check your access</h1><p>Something went wrong while checking whether you can use this app. Please try again in a minute.</p></body></html>`)
+		return
+	}
+	log.Printf("access denied for %s %s (%s): %v", a.Provider, a.Identity.ID, a.Identity.Email, err)
+	w.WriteHeader(http.StatusForbidden)
+	fmt.Fprintf(w, `<html><body><h1>Access denied</h1><p>Your account is not allowed to use this app.</p><p>Signed in as %s. <a href="/logout">Sign in with a different account</a></p></body></html>`,
+		html.EscapeString(a.label()))
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func withAccessRules(t *testing.T, p accessPolicy) {
+	saved := accessRules
+	accessRules = p
+	t.Cleanup(func() { accessRules = saved })
+}
+
+func TestAccessRules(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		policy  accessPolicy
+		teams   []fakeTeam
+		allowed bool
+		// unverified signs in with an email Heroku hasn't verified.
+		unverified bool
+	}{
+		{"no rules", accessPolicy{}, nil, true, false},
+		{"allowed domain", accessPolicy{Domains: []string{"example.com"}}, nil, true, false},
+		{"other domain", accessPolicy{Domains: []string{"example.org"}}, nil, false, false},
+		{"allowed email", accessPolicy{Users: []string{"user@example.com"}}, nil, true, false},
+		{"allowed id", accessPolicy{Users: []string{"01234567-89ab-cdef-0123-456789abcdef"}}, nil, true, false},
+		{"allowed team", accessPolicy{Teams: []string{"ops"}}, []fakeTeam{{Name: "ops", Role: "member"}}, true, false},
+		{"other team", accessPolicy{Teams: []string{"ops"}}, []fakeTeam{{Name: "dev", Role: "admin"}}, false, false},
+		{"unverified domain", accessPolicy{Domains: []string{"example.com"}}, nil, false, true},
+		{"unverified email", accessPolicy{Users: []string{"user@example.com"}}, nil, false, true},
+		{"unverified id", accessPolicy{Users: []string{"01234567-89ab-cdef-0123-456789abcdef"}}, nil, true, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			withAccessRules(t, tt.policy)
+			app := newTestApp(t)
+			app.heroku.Teams = tt.teams
+			app.heroku.User.Verified = !tt.unverified
+
+			resp, body := app.get(t, "/auth/heroku")
+			if tt.allowed && resp.StatusCode != http.StatusOK {
+				t.Errorf("login = %d, want allowed: %s", resp.StatusCode, body)
+			}
+			if !tt.allowed && resp.StatusCode != http.StatusForbidden {
+				t.Errorf("login = %d, want %d: %s", resp.StatusCode, http.StatusForbidden, body)
+			}
+		})
+	}
+}
+
+func TestAccessRecheck(t *testing.T) {
+	withAccessRules(t, accessPolicy{Teams: []string{"ops"}, Recheck: time.Nanosecond})
+	app := newTestApp(t)
+	app.heroku.Teams = []fakeTeam{{Name: "ops", Role: "member"}}
+	app.login(t)
+
+	app.heroku.Teams = nil
+	if resp, body := app.get(t, "/user"); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("GET /user after leaving the team = %d: %s", resp.StatusCode, body)
+	}
+	if resp, _ := app.get(t, "/user"); resp.Request.URL.Path != "/" {
+		t.Errorf("denied account was not removed from the session; ended at %s", resp.Request.URL)
+	}
+}
+
+func TestAccessRecheckOutage(t *testing.T) {
+	withAccessRules(t, accessPolicy{Teams: []string{"ops"}, Recheck: time.Nanosecond})
+	app := newTestApp(t)
+	app.heroku.Teams = []fakeTeam{{Name: "ops", Role: "member"}}
+	app.login(t)
+
+	app.heroku.failWith("teams", http.StatusInternalServerError)
+	resp, body := app.get(t, "/user")
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("GET /user while teams fail = %d: %s", resp.StatusCode, body)
+	}
+	if strings.Contains(body, "Access denied") || !strings.Contains(body, "try again") {
+		t.Errorf("outage page reads as a refusal: %s", body)
+	}
+	app.heroku.failWith("teams", 0)
+	if resp, body := app.get(t, "/user"); resp.Request.URL.Path != "/user" || resp.StatusCode != http.StatusOK {
+		t.Errorf("account did not survive the outage; GET /user = %d at %s: %s", resp.StatusCode, resp.Request.URL, body)
+	}
+}
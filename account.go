@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"golang.org/x/oauth2"
+)
+
+var sessionName = getenvDefault("SESSION_COOKIE_NAME", "heroku-oauth-example-go")
+
+// maxAccounts bounds how many linked accounts a session may hold. Each takes
+// about 650 bytes of the cookie, mostly tokens and email, and securecookie
+// refuses to encode more than 4KB, so three leave room for the rest of the
+// session.
+const maxAccounts = 3
+
+// account is one linked login held in the session.
+type account struct {
+	Provider    string
+	Identity    identity
+	Token       *oauth2.Token
+	Scopes      []string
+	LinkedAt    time.Time
+	LastRefresh time.Time
+	CheckedAt   time.Time
+
+	changed bool // needs saving to the session
+}
+
+func (a *account) key() string {
+	return a.Provider + ":" + a.Identity.ID
+}
+
+func (a *account) label() string {
+	if a.Identity.Email != "" {
+		return a.Identity.Email
+	}
+	return a.Identity.Name
+}
+
+// client returns an HTTP client authorized as a. Tokens refreshed while
+// using it are written back to a so they can be saved to the session.
+func (a *account) client(ctx context.Context) (*http.Client, error) {
+	p, ok := lookupProvider(a.Provider)
+	if !ok {
+		return nil, fmt.Errorf("unknown provider %q", a.Provider)
+	}
+	src := &accountTokenSource{ctx: ctx, config: p.Config, a: a}
+	return oauth2.NewClient(ctx, src), nil
+}
+
+type accountTokenSource struct {
+	ctx    context.Context
+	config *oauth2.Config
+	a      *account
+}
+
+func (s *accountTokenSource) Token() (*oauth2.Token, error) {
+	if s.a.Token.Valid() {
+		return s.a.Token, nil
+	}
+	t, err := sharedRefresh(s.ctx, s.config, s.a.Token.RefreshToken)
+	if err != nil {
+		audits.record(nil, s.a, auditEvent{Action: "token.refresh", Target: s.a.Provider, Outcome: auditFailure, Detail: err.Error()})
+		return nil, err
+	}
+	if t.AccessToken != s.a.Token.AccessToken {
+		s.a.Token = t
+		s.a.LastRefresh = time.Now()
+		s.a.changed = true
+	}
+	return t, nil
+}
+
+func init() {
+	gob.Register([]*account{})
+}
+
+func sessionAccounts(s *sessions.Session) []*account {
+	accounts, _ := s.Values["accounts"].([]*account)
+	return accounts
+}
+
+func currentAccount(s *sessions.Session) (*account, bool) {
+	key, _ := s.Values["current-account"].(string)
+	for _, a := range sessionAccounts(s) {
+		if a.key() == key {
+			return a, true
+		}
+	}
+	return nil, false
+}
+
+// addAccount links a to the session, replacing any existing entry for the
+// same login, and makes it the current account.
+func addAccount(s *sessions.Session, a *account) {
+	accounts := []*account{a}
+	for _, b := range sessionAccounts(s) {
+		if b.key() != a.key() {
+			accounts = append(accounts, b)
+		}
+	}
+	if len(accounts) > maxAccounts {
+		accounts = accounts[:maxAccounts]
+	}
+	s.Values["accounts"] = accounts
+	s.Values["current-account"] = a.key()
+}
+
+func removeAccount(s *sessions.Session, key string) {
+	var accounts []*account
+	for _, a := range sessionAccounts(s) {
+		if a.key() != key {
+			accounts = append(accounts, a)
+		}
+	}
+	s.Values["accounts"] = accounts
+	if cur, _ := s.Values["current-account"].(string); cur == key {
+		delete(s.Values, "current-account")
+		if len(accounts) > 0 {
+			s.Values["current-account"] = accounts[0].key()
+		}
+	}
+}
+
+// accountHandler is a handler that operates on the session's current account.
+type accountHandler func(w http.ResponseWriter, r *http.Request, s *sessions.Session, a *account)
+
+// withAccount loads the current account for h, sending visitors without one
+// back to sign in. Refreshed tokens are saved before h writes its response.
+func withAccount(h accountHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, err := loadSession(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		a, ok := currentAccount(session)
+		if !ok {
+			setReturnTo(session, r)
+			if err := session.Save(r, w); err != nil {
+				log.Printf("saving session: %v", err)
+			}
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+		if created, err := ensureCSRFToken(session); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		} else if created {
+			if err := session.Save(r, w); err != nil {
+				log.Printf("saving session: %v", err)
+			}
+		}
+		if accessRules.due(a, time.Now()) {
+			ctx, cancel := outboundContext(r.Context(), apiTimeout)
+			err := recheckAccess(ctx, a)
+			cancel()
+			if errors.Is(err, errAccessDenied) {
+				audits.record(r, a, auditEvent{Action: "access.recheck", Target: a.Provider, Outcome: auditDenied, Detail: err.Error()})
+				removeAccount(session, a.key())
+				if err := session.Save(r, w); err != nil {
+					log.Printf("saving session: %v", err)
+				}
+				denyAccess(w, a, err)
+				return
+			}
+			if err != nil {
+				// The account stays signed in; the check runs again next request.
+				audits.record(r, a, auditEvent{Action: "access.recheck", Target: a.Provider, Outcome: auditFailure, Detail: err.Error()})
+				denyAccess(w, a, err)
+				return
+			}
+		}
+		h(&refreshSaver{ResponseWriter: w, r: r, s: session, a: a}, r, session, a)
+	}
+}
+
+// refreshSaver saves the session ahead of the response if the account
+// changed, typically by refreshing its token, while handling the request.
+type refreshSaver struct {
+	http.ResponseWriter
+	r     *http.Request
+	s     *sessions.Session
+	a     *account
+	saved bool
+}
+
+func (w *refreshSaver) save() {
+	if w.saved || !w.a.changed {
+		return
+	}
+	w.saved = true
+	if err := w.s.Save(w.r, w.ResponseWriter); err != nil {
+		log.Printf("saving session: %v", err)
+	}
+}
+
+func (w *refreshSaver) WriteHeader(code int) {
+	w.save()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *refreshSaver) Write(b []byte) (int, error) {
+	w.save()
+	return w.ResponseWriter.Write(b)
+}
+
+// writeAccountBar renders the account switcher shown at the top of pages.
+func writeAccountBar(w http.ResponseWriter, s *sessions.Session, cur *account) {
+	fmt.Fprint(w, `<form method="post" action="/accounts/switch" style="float:right">`+csrfInput(s))
+	fmt.Fprint(w, `<select name="account" onchange="this.form.submit()">`)
+	for _, a := range sessionAccounts(s) {
+		selected := ""
+		if a.key() == cur.key() {
+			selected = " selected"
+		}
+		fmt.Fprintf(w, `<option value="%s"%s>%s</option>`, html.EscapeString(a.key()), selected, html.EscapeString(a.label()))
+	}
+	fmt.Fprint(w, `</select> <a href="/accounts">Manage accounts</a></form>`)
+	writeExpiryWarning(w, s, cur, time.Now())
+}
+
+func handleAccounts(w http.ResponseWriter, r *http.Request, s *sessions.Session, cur *account) {
+	fmt.Fprint(w, `<html><body><h1>Linked accounts</h1><ul>`)
+	for _, a := range sessionAccounts(s) {
+		current := ""
+		if a.key() == cur.key() {
+			current = " (current)"
+		}
+		fmt.Fprintf(w, `<li>%s%s <form method="post" action="/accounts/switch" style="display:inline">%[4]s<button name="account" value="%[3]s">Switch</button></form>`+
+			` <form method="post" action="/accounts/remove" style="display:inline">%[4]s<button name="account" value="%[3]s">Remove</button></form></li>`,
+			html.EscapeString(a.label()), current, html.EscapeString(a.key()), csrfInput(s))
+	}
+	fmt.Fprint(w, `</ul><p><a href="/auth/heroku?add=1">Add another Heroku account</a></p></body></html>`)
+}
+
+func handleAccountSwitch(w http.ResponseWriter, r *http.Request) {
+	session, err := loadSession(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	key := r.FormValue("account")
+	found := false
+	for _, a := range sessionAccounts(session) {
+		found = found || a.key() == key
+	}
+	if !found {
+		http.Error(w, "Unknown account", http.StatusBadRequest)
+		return
+	}
+	from, _ := currentAccount(session)
+	if err := regenerateSession(session); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	session.Values["current-account"] = key
+	to, _ := currentAccount(session)
+	audits.record(r, from, auditEvent{Action: "account.switch", Target: to.key(), Outcome: auditSuccess})
+	if err := session.Save(r, w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/user", http.StatusFound)
+}
+
+func handleAccountRemove(w http.ResponseWriter, r *http.Request) {
+	session, err := loadSession(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	cur, _ := currentAccount(session)
+	audits.record(r, cur, auditEvent{Action: "account.remove", Target: r.FormValue("account"), Outcome: auditSuccess})
+	removeAccount(session, r.FormValue("account"))
+	if err := session.Save(r, w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/accounts", http.StatusFound)
+}
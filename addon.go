@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// partnerClient is the part of the Heroku Add-on Partner API used while
+// provisioning. See https://devcenter.heroku.com/articles/add-on-partner-api-reference
+type partnerClient interface {
+	// ExchangeGrant trades the OAuth grant sent with a provision request for
+	// an access and refresh token scoped to the resource.
+	ExchangeGrant(ctx context.Context, code string) (*oauth2.Token, error)
+	// SetConfig sets the resource's config vars on the app it is attached to.
+	SetConfig(ctx context.Context, token *oauth2.Token, id string, config map[string]string) error
+	// MarkProvisioned completes an asynchronous provision.
+	MarkProvisioned(ctx context.Context, token *oauth2.Token, id string) error
+}
+
+var (
+	addonPassword                   = getenv("ADDON_PASSWORD")
+	addonAsync                      = getenv("ADDON_ASYNC") == "true"
+	addonClientSecret               = getenv("ADDON_CLIENT_SECRET")
+	addonTokenURL                   = oauthConfig.Endpoint.TokenURL
+	partner           partnerClient = herokuPartner{}
+)
+
+// addonToken requests a resource token. Add-on grants are exchanged with the
+// client secret alone, sent as a form value rather than in an Authorization
+// header, which oauth2.Config can only be taught for the whole token URL
+// and so for Heroku sign in too.
+func addonToken(ctx context.Context, form url.Values) (*oauth2.Token, error) {
+	client, _ := ctx.Value(oauth2.HTTPClient).(*http.Client)
+	if client == nil {
+		client = http.DefaultClient
+	}
+	form.Set("client_secret", addonClientSecret)
+	resp, err := client.PostForm(addonTokenURL, form)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("POST %s: %s", addonTokenURL, resp.Status)
+	}
+	var t struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		TokenType    string `json:"token_type"`
+		ExpiresIn    int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&t); err != nil {
+		return nil, err
+	}
+	if t.AccessToken == "" {
+		return nil, errors.New("token response has no access_token")
+	}
+	token := &oauth2.Token{AccessToken: t.AccessToken, RefreshToken: t.RefreshToken, TokenType: t.TokenType}
+	if t.ExpiresIn > 0 {
+		token.Expiry = time.Now().Add(time.Duration(t.ExpiresIn) * time.Second)
+	}
+	return token, nil
+}
+
+// addonRefresher refreshes a resource token through addonToken.
+type addonRefresher struct {
+	ctx     context.Context
+	refresh string
+}
+
+func (s addonRefresher) Token() (*oauth2.Token, error) {
+	return addonToken(s.ctx, url.Values{"grant_type": {"refresh_token"}, "refresh_token": {s.refresh}})
+}
+
+func addonClient(ctx context.Context, token *oauth2.Token) *http.Client {
+	return oauth2.NewClient(ctx, oauth2.ReuseTokenSource(token, addonRefresher{ctx, token.RefreshToken}))
+}
+
+// herokuPartner implements partnerClient against the Heroku API.
+type herokuPartner struct{}
+
+func (herokuPartner) ExchangeGrant(ctx context.Context, code string) (*oauth2.Token, error) {
+	return addonToken(ctx, url.Values{"grant_type": {"authorization_code"}, "code": {code}})
+}
+
+func (herokuPartner) SetConfig(ctx context.Context, token *oauth2.Token, id string, config map[string]string) error {
+	var vars []map[string]string
+	for k, v := range config {
+		vars = append(vars, map[string]string{"name": k, "value": v})
+	}
+	client := addonClient(ctx, token)
+	return herokuDo(client, "PATCH", "/addons/"+url.PathEscape(id)+"/config", map[string]interface{}{"config": vars}, nil)
+}
+
+func (herokuPartner) MarkProvisioned(ctx context.Context, token *oauth2.Token, id string) error {
+	client := addonClient(ctx, token)
+	return herokuDo(client, "POST", "/addons/"+url.PathEscape(id)+"/actions/provision", nil, nil)
+}
+
+// resourceConfig returns the config vars set on apps a resource is attached
+// to. Every resource shares the one app, reached from the dashboard by SSO.
+func resourceConfig() map[string]string {
+	return map[string]string{
+		getenvDefault("ADDON_CONFIG_VAR", "OAUTH_EXAMPLE_URL"): appURL + "/",
+	}
+}
+
+// provisionRequest is the body Heroku sends to provision a resource. See
+// https://devcenter.heroku.com/articles/add-on-partner-api-reference#add-on-provision
+type provisionRequest struct {
+	UUID       string `json:"uuid"`
+	Plan       string `json:"plan"`
+	Region     string `json:"region"`
+	OAuthGrant *struct {
+		Code      string    `json:"code"`
+		Type      string    `json:"type"`
+		ExpiresAt time.Time `json:"expires_at"`
+	} `json:"oauth_grant"`
+}
+
+// addonAuth guards the add-on provisioning API under /heroku/resources with
+// the basic auth credentials Heroku was given in the add-on manifest.
+func addonAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if addonPassword == "" || !ok ||
+			subtle.ConstantTimeCompare([]byte(user), []byte(addonID)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(pass), []byte(addonPassword)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="heroku"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func handleProvision(w http.ResponseWriter, r *http.Request) {
+	var req provisionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.UUID == "" {
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"message": "invalid provision request"})
+		return
+	}
+	if existing, ok, err := resources.get(req.UUID); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"message": err.Error()})
+		return
+	} else if ok && existing.State != resourceFailed {
+		// Heroku retries provision requests; answer them idempotently, and
+		// start a failed one over.
+		writeProvisionResponse(w, existing)
+		return
+	}
+
+	res := resource{ID: req.UUID, Plan: req.Plan, Region: req.Region, State: resourceProvisioning, CreatedAt: time.Now()}
+	if err := resources.put(res); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"message": err.Error()})
+		return
+	}
+	var code string
+	if req.OAuthGrant != nil {
+		code = req.OAuthGrant.Code
+	}
+	if addonAsync {
+		go func() {
+			ctx, cancel := outboundContext(context.Background(), time.Minute)
+			defer cancel()
+			provision(ctx, res.ID, code, true)
+		}()
+		writeJSON(w, http.StatusAccepted, map[string]string{"id": res.ID, "message": "Provisioning is in progress."})
+		return
+	}
+	ctx, cancel := outboundContext(r.Context(), exchangeTimeout)
+	defer cancel()
+	if err := provision(ctx, res.ID, code, false); err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"message": err.Error()})
+		return
+	}
+	res, _, _ = resources.get(res.ID)
+	writeProvisionResponse(w, res)
+}
+
+func writeProvisionResponse(w http.ResponseWriter, res resource) {
+	switch res.State {
+	case resourceProvisioning:
+		writeJSON(w, http.StatusAccepted, map[string]string{"id": res.ID, "message": "Provisioning is in progress."})
+		return
+	case resourceFailed:
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"message": res.Error})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"id": res.ID, "config": resourceConfig(), "message": "Provisioned."})
+}
+
+// provision exchanges the resource's OAuth grant and, for asynchronous
+// provisions, sets its config and tells Heroku it is ready.
+func provision(ctx context.Context, id, code string, async bool) error {
+	err := func() error {
+		if code == "" {
+			if async {
+				// Without a token Heroku can't be told the resource is
+				// ready, and would wait on it until it timed out.
+				return errors.New("no OAuth grant to complete an asynchronous provision with")
+			}
+			return nil
+		}
+		token, err := partner.ExchangeGrant(ctx, code)
+		if err != nil {
+			return err
+		}
+		if _, err := resources.update(id, func(r *resource) { r.Token = token }); err != nil {
+			return err
+		}
+		if !async {
+			return nil
+		}
+		if err := partner.SetConfig(ctx, token, id, resourceConfig()); err != nil {
+			return err
+		}
+		return partner.MarkProvisioned(ctx, token, id)
+	}()
+	_, uerr := resources.update(id, func(r *resource) {
+		if err != nil {
+			r.State, r.Error = resourceFailed, err.Error()
+		} else {
+			r.State, r.Error = resourceProvisioned, ""
+		}
+	})
+	if err != nil {
+		log.Printf("provisioning %s: %v", id, err)
+		return err
+	}
+	return uerr
+}
+
+func handlePlanChange(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	var req struct {
+		Plan string `json:"plan"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Plan == "" {
+		writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"message": "invalid plan change request"})
+		return
+	}
+	ok, err := resources.update(id, func(res *resource) { res.Plan = req.Plan })
+	switch {
+	case err != nil:
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"message": err.Error()})
+	case !ok:
+		writeJSON(w, http.StatusNotFound, map[string]string{"message": "resource not found"})
+	default:
+		writeJSON(w, http.StatusOK, map[string]interface{}{"config": resourceConfig(), "message": "Plan changed to " + req.Plan + "."})
+	}
+}
+
+func handleDeprovision(w http.ResponseWriter, r *http.Request) {
+	ok, err := resources.delete(r.PathValue("id"))
+	switch {
+	case err != nil:
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"message": err.Error()})
+	case !ok:
+		// Heroku considers 410 Gone a successful deprovision.
+		writeJSON(w, http.StatusGone, map[string]string{"message": "resource not found"})
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
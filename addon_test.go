@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// fakePartner records calls made to the add-on partner API.
+type fakePartner struct {
+	mu          sync.Mutex
+	failGrant   bool
+	configs     map[string]map[string]string
+	provisioned map[string]bool
+}
+
+func (p *fakePartner) ExchangeGrant(ctx context.Context, code string) (*oauth2.Token, error) {
+	if p.failGrant {
+		return nil, errors.New("invalid grant")
+	}
+	return &oauth2.Token{AccessToken: "access-" + code, RefreshToken: "refresh-" + code, Expiry: time.Now().Add(8 * time.Hour)}, nil
+}
+
+func (p *fakePartner) SetConfig(ctx context.Context, token *oauth2.Token, id string, config map[string]string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.configs[id] = config
+	return nil
+}
+
+func (p *fakePartner) MarkProvisioned(ctx context.Context, token *oauth2.Token, id string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.provisioned[id] = true
+	return nil
+}
+
+func (p *fakePartner) isProvisioned(id string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.provisioned[id]
+}
+
+var resourceKey = strings.Repeat("cd", 32)
+
+func setupAddon(t *testing.T, async bool) (*fakePartner, string) {
+	p := &fakePartner{configs: map[string]map[string]string{}, provisioned: map[string]bool{}}
+	path := filepath.Join(t.TempDir(), "resources.json")
+	savedPartner, savedResources, savedPassword, savedAsync := partner, resources, addonPassword, addonAsync
+	t.Cleanup(func() {
+		partner, resources, addonPassword, addonAsync = savedPartner, savedResources, savedPassword, savedAsync
+	})
+	resources, _ = newResourceStore(path, resourceKey)
+	partner, addonPassword, addonAsync = p, "password", async
+	return p, path
+}
+
+func resourceRequest(method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.SetBasicAuth(addonID, "password")
+	rec := httptest.NewRecorder()
+	newRoutes().ServeHTTP(rec, req)
+	return rec
+}
+
+const provisionBody = `{"uuid":"res-1","plan":"basic","region":"amazon-web-services::us-east-1","oauth_grant":{"code":"grant-1","type":"authorization_code"}}`
+
+func TestProvisionSync(t *testing.T) {
+	_, path := setupAddon(t, false)
+
+	rec := resourceRequest("POST", "/heroku/resources", provisionBody)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("provision = %d: %s", rec.Code, rec.Body)
+	}
+	var resp struct {
+		ID     string            `json:"id"`
+		Config map[string]string `json:"config"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if resp.ID != "res-1" || len(resp.Config) == 0 {
+		t.Errorf("provision response = %s", rec.Body)
+	}
+
+	// A fresh store reading the same file sees the exchanged token, which
+	// is not on disk in plaintext.
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "grant-1") {
+		t.Errorf("resource store holds a plaintext token: %s", b)
+	}
+	fresh, _ := newResourceStore(path, resourceKey)
+	res, ok, err := fresh.get("res-1")
+	if err != nil || !ok {
+		t.Fatalf("resource not persisted: %v", err)
+	}
+	if _, _, err := (&resourceStore{path: path}).get("res-1"); err == nil {
+		t.Error("read sealed tokens without a key")
+	}
+	if res.State != resourceProvisioned || res.Token == nil || res.Token.RefreshToken != "refresh-grant-1" {
+		t.Errorf("stored resource = %+v", res)
+	}
+
+	if rec := resourceRequest("POST", "/heroku/resources", provisionBody); rec.Code != http.StatusOK {
+		t.Errorf("repeated provision = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestProvisionAsync(t *testing.T) {
+	p, _ := setupAddon(t, true)
+
+	if rec := resourceRequest("POST", "/heroku/resources", provisionBody); rec.Code != http.StatusAccepted {
+		t.Fatalf("provision = %d: %s", rec.Code, rec.Body)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		res, _, err := resources.get("res-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.State != resourceProvisioning {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("provisioning never finished")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !p.isProvisioned("res-1") {
+		t.Error("resource was not marked provisioned")
+	}
+	p.mu.Lock()
+	config := p.configs["res-1"]
+	p.mu.Unlock()
+	if len(config) == 0 {
+		t.Error("config vars were not set")
+	}
+}
+
+func TestProvisionAsyncWithoutGrant(t *testing.T) {
+	p, _ := setupAddon(t, true)
+
+	resourceRequest("POST", "/heroku/resources", `{"uuid":"res-1","plan":"basic"}`)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		res, _, err := resources.get("res-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.State == resourceFailed {
+			break
+		}
+		if res.State != resourceProvisioning || time.Now().After(deadline) {
+			t.Fatalf("resource state = %q, want %q", res.State, resourceFailed)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if p.isProvisioned("res-1") {
+		t.Error("resource without a grant was marked provisioned")
+	}
+}
+
+func TestProvisionGrantFailure(t *testing.T) {
+	p, _ := setupAddon(t, false)
+	p.failGrant = true
+
+	if rec := resourceRequest("POST", "/heroku/resources", provisionBody); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("provision with a bad grant = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	if res, _, _ := resources.get("res-1"); res.State != resourceFailed {
+		t.Errorf("resource state = %q, want %q", res.State, resourceFailed)
+	}
+
+	// Heroku's retry provisions it again rather than reporting success.
+	p.failGrant = false
+	if rec := resourceRequest("POST", "/heroku/resources", provisionBody); rec.Code != http.StatusOK {
+		t.Errorf("retried provision = %d: %s", rec.Code, rec.Body)
+	}
+	if res, _, _ := resources.get("res-1"); res.State != resourceProvisioned || res.Token == nil {
+		t.Errorf("retried resource = %+v", res)
+	}
+}
+
+func TestAddonGrantExchange(t *testing.T) {
+	var got url.Values
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, _, ok := r.BasicAuth(); ok {
+			t.Error("grant exchange sent an Authorization header")
+		}
+		r.ParseForm()
+		got = r.PostForm
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"a","refresh_token":"r","token_type":"Bearer","expires_in":28800}`))
+	}))
+	defer ts.Close()
+	savedURL, savedSecret := addonTokenURL, addonClientSecret
+	defer func() { addonTokenURL, addonClientSecret = savedURL, savedSecret }()
+	addonTokenURL, addonClientSecret = ts.URL, "addon-secret"
+
+	token, err := herokuPartner{}.ExchangeGrant(context.Background(), "grant-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.AccessToken != "a" || token.RefreshToken != "r" || time.Until(token.Expiry) < 7*time.Hour {
+		t.Errorf("token = %+v", token)
+	}
+	if got.Get("grant_type") != "authorization_code" || got.Get("code") != "grant-1" || got.Get("client_secret") != "addon-secret" {
+		t.Errorf("exchange form = %v", got)
+	}
+}
+
+func TestPlanChangeAndDeprovision(t *testing.T) {
+	setupAddon(t, false)
+	resourceRequest("POST", "/heroku/resources", provisionBody)
+
+	if rec := resourceRequest("PUT", "/heroku/resources/res-1", `{"plan":"premium"}`); rec.Code != http.StatusOK {
+		t.Errorf("plan change = %d: %s", rec.Code, rec.Body)
+	}
+	if res, _, _ := resources.get("res-1"); res.Plan != "premium" {
+		t.Errorf("plan = %q, want premium", res.Plan)
+	}
+	if rec := resourceRequest("PUT", "/heroku/resources/missing", `{"plan":"premium"}`); rec.Code != http.StatusNotFound {
+		t.Errorf("plan change of a missing resource = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	if rec := resourceRequest("DELETE", "/heroku/resources/res-1", ""); rec.Code != http.StatusNoContent {
+		t.Errorf("deprovision = %d", rec.Code)
+	}
+	if rec := resourceRequest("DELETE", "/heroku/resources/res-1", ""); rec.Code != http.StatusGone {
+		t.Errorf("repeated deprovision = %d, want %d", rec.Code, http.StatusGone)
+	}
+}
+
+func TestResourcesRequireAuth(t *testing.T) {
+	setupAddon(t, false)
+	req := httptest.NewRequest("POST", "/heroku/resources", strings.NewReader(provisionBody))
+	req.SetBasicAuth(addonID, "wrong")
+	rec := httptest.NewRecorder()
+	newRoutes().ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("provision with a bad password = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
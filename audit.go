@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// auditEvent is one line of the audit log.
+type auditEvent struct {
+	Time       time.Time `json:"time"`
+	Action     string    `json:"action"`
+	ActorID    string    `json:"actor_id,omitempty"`
+	ActorEmail string    `json:"actor_email,omitempty"`
+	SourceIP   string    `json:"source_ip,omitempty"`
+	RequestID  string    `json:"request_id,omitempty"`
+	Target     string    `json:"target,omitempty"`
+	Outcome    string    `json:"outcome"`
+	Detail     string    `json:"detail,omitempty"`
+}
+
+// Audit outcomes.
+const (
+	auditSuccess = "success"
+	auditFailure = "failure"
+	auditDenied  = "denied"
+)
+
+// auditLog appends events as JSON lines to a sink and keeps the most recent
+// ones in memory for the admin page.
+type auditLog struct {
+	mu     sync.Mutex
+	sink   io.Writer
+	recent []auditEvent
+	max    int
+}
+
+var audits = &auditLog{sink: newAuditSink(), max: 1000}
+
+// newAuditSink returns the writer named by AUDIT_LOG: "stdout" (the
+// default) or the path of a file that is rotated once it reaches
+// AUDIT_LOG_MAX_BYTES.
+func newAuditSink() io.Writer {
+	path := getenvDefault("AUDIT_LOG", "stdout")
+	if path == "stdout" {
+		return os.Stdout
+	}
+	max, err := strconv.ParseInt(getenvDefault("AUDIT_LOG_MAX_BYTES", "10485760"), 10, 64)
+	if err != nil {
+		log.Fatalf("AUDIT_LOG_MAX_BYTES: %v", err)
+	}
+	return &rotatingFile{path: path, maxBytes: max, keep: 5}
+}
+
+// record fills in the request and actor details of e and appends it to the
+// log. r and a may be nil for events outside a request or before sign in.
+func (l *auditLog) record(r *http.Request, a *account, e auditEvent) {
+	e.Time = time.Now().UTC()
+	if a != nil {
+		e.ActorID, e.ActorEmail = a.Identity.ID, a.Identity.Email
+	}
+	if r != nil {
+		e.SourceIP = sourceIP(r)
+		e.RequestID = r.Header.Get("X-Request-ID") // See https://devcenter.heroku.com/articles/http-request-id
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("encoding audit event: %v", err)
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.sink.Write(append(b, '\n')); err != nil {
+		log.Printf("writing audit event: %v", err)
+	}
+	l.recent = append(l.recent, e)
+	if len(l.recent) > l.max {
+		l.recent = l.recent[len(l.recent)-l.max:]
+	}
+}
+
+// events returns the recent events matching filter, newest first.
+func (l *auditLog) events(filter func(auditEvent) bool) []auditEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var events []auditEvent
+	for i := len(l.recent) - 1; i >= 0; i-- {
+		if filter(l.recent[i]) {
+			events = append(events, l.recent[i])
+		}
+	}
+	return events
+}
+
+// sourceIP returns the client address. The Heroku router appends the address
+// it saw to X-Forwarded-For, so the last entry is the one that can be
+// trusted.
+func sourceIP(r *http.Request) string {
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		parts := strings.Split(xff, ",")
+		return strings.TrimSpace(parts[len(parts)-1])
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// rotatingFile appends to path, moving it aside to path.1, path.2, ... once
+// it grows past maxBytes.
+type rotatingFile struct {
+	path     string
+	maxBytes int64
+	keep     int
+
+	f    *os.File
+	size int64
+}
+
+func (rf *rotatingFile) Write(b []byte) (int, error) {
+	if rf.f != nil && rf.size+int64(len(b)) > rf.maxBytes {
+		rf.f.Close()
+		rf.f = nil
+		for i := rf.keep - 1; i > 0; i-- {
+			os.Rename(rf.path+"."+strconv.Itoa(i), rf.path+"."+strconv.Itoa(i+1))
+		}
+		if err := os.Rename(rf.path, rf.path+".1"); err != nil {
+			return 0, err
+		}
+	}
+	if rf.f == nil {
+		f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return 0, err
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return 0, err
+		}
+		rf.f, rf.size = f, fi.Size()
+	}
+	n, err := rf.f.Write(b)
+	rf.size += int64(n)
+	return n, err
+}
+
+var adminUsers = strings.Fields(strings.Replace(strings.ToLower(getenv("ADMIN_USERS")), ",", " ", -1))
+
+// isAdmin reports whether a is a Heroku account listed in ADMIN_USERS by ID
+// or verified email. Other providers' IDs and emails are not Heroku's to vouch
+// for.
+func isAdmin(a *account) bool {
+	if a.Provider != "heroku" {
+		return false
+	}
+	for _, u := range adminUsers {
+		if u == strings.ToLower(a.Identity.ID) || a.Identity.Verified && u == strings.ToLower(a.Identity.Email) {
+			return true
+		}
+	}
+	return false
+}
+
+// withAdmin is withAccount restricted to administrators.
+func withAdmin(h accountHandler) http.HandlerFunc {
+	return withAccount(func(w http.ResponseWriter, r *http.Request, s *sessions.Session, a *account) {
+		if !isAdmin(a) {
+			audits.record(r, a, auditEvent{Action: "admin.access", Target: r.URL.Path, Outcome: auditDenied})
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		h(w, r, s, a)
+	})
+}
+
+func handleAdminAudit(w http.ResponseWriter, r *http.Request, s *sessions.Session, a *account) {
+	actor := strings.ToLower(r.FormValue("actor"))
+	action := r.FormValue("action")
+	outcome := r.FormValue("outcome")
+	events := audits.events(func(e auditEvent) bool {
+		return (actor == "" || strings.ToLower(e.ActorID) == actor || strings.ToLower(e.ActorEmail) == actor) &&
+			(action == "" || strings.HasPrefix(e.Action, action)) &&
+			(outcome == "" || e.Outcome == outcome)
+	})
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(events)
+		return
+	}
+
+	fmt.Fprint(w, `<html><body>`)
+	writeAccountBar(w, s, a)
+	fmt.Fprintf(w, `<h1>Audit log</h1><form>Actor <input name="actor" value="%s"> Action <input name="action" value="%s"> Outcome <select name="outcome">`,
+		html.EscapeString(actor), html.EscapeString(action))
+	for _, o := range []string{"", auditSuccess, auditFailure, auditDenied} {
+		selected := ""
+		if o == outcome {
+			selected = " selected"
+		}
+		fmt.Fprintf(w, `<option%s>%s</option>`, selected, o)
+	}
+	fmt.Fprint(w, `</select> <button>Filter</button></form><table><tr><th>Time</th><th>Action</th><th>Actor</th><th>Source IP</th><th>Request ID</th><th>Target</th><th>Outcome</th><th>Detail</th></tr>`)
+	for _, e := range events {
+		fmt.Fprint(w, `<tr>`)
+		for _, v := range []string{e.Time.Format(time.RFC3339), e.Action, e.ActorEmail, e.SourceIP, e.RequestID, e.Target, e.Outcome, e.Detail} {
+			fmt.Fprintf(w, `<td>%s</td>`, html.EscapeString(v))
+		}
+		fmt.Fprint(w, `</tr>`)
+	}
+	fmt.Fprint(w, `</table></body></html>`)
+}
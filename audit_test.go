@@ -0,0 +1,118 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuditLoginLogout(t *testing.T) {
+	app := newTestApp(t)
+	app.login(t)
+	app.get(t, "/logout")
+
+	var actions []string
+	for _, e := range audits.events(func(auditEvent) bool { return true }) {
+		if e.ActorID != app.heroku.User.ID || e.SourceIP == "" || e.Outcome != auditSuccess {
+			t.Errorf("unexpected event %+v", e)
+		}
+		actions = append(actions, e.Action)
+	}
+	if got := strings.Join(actions, ","); got != "logout,login" {
+		t.Errorf("audited %s, want logout,login", got)
+	}
+}
+
+func TestAuditFailedCallback(t *testing.T) {
+	app := newTestApp(t)
+	app.heroku.failWith("token", http.StatusInternalServerError)
+	app.get(t, "/auth/heroku")
+
+	events := audits.events(func(e auditEvent) bool { return e.Action == "login" && e.Outcome == auditFailure })
+	if len(events) != 1 {
+		t.Errorf("got %d failed login events, want 1", len(events))
+	}
+}
+
+func TestAdminAudit(t *testing.T) {
+	app := newTestApp(t)
+	app.login(t)
+	if resp, _ := app.get(t, "/admin/audit"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("GET /admin/audit as a non-admin = %d, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+
+	saved := adminUsers
+	adminUsers = []string{app.heroku.User.Email}
+	defer func() { adminUsers = saved }()
+	resp, body := app.get(t, "/admin/audit?action=login")
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, "<td>login</td>") || strings.Contains(body, "<td>admin.access</td>") {
+		t.Errorf("GET /admin/audit as an admin = %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestIsAdmin(t *testing.T) {
+	saved := adminUsers
+	adminUsers = []string{"01234567-89ab-cdef-0123-456789abcdef", "admin@example.com"}
+	defer func() { adminUsers = saved }()
+
+	for _, tt := range []struct {
+		name  string
+		a     account
+		admin bool
+	}{
+		{"heroku id", account{Provider: "heroku", Identity: identity{ID: "01234567-89ab-cdef-0123-456789abcdef"}}, true},
+		{"heroku email", account{Provider: "heroku", Identity: identity{ID: "1", Email: "Admin@example.com", Verified: true}}, true},
+		{"unverified email", account{Provider: "heroku", Identity: identity{ID: "1", Email: "admin@example.com"}}, false},
+		{"github email", account{Provider: "github", Identity: identity{ID: "1", Email: "admin@example.com", Verified: true}}, false},
+		{"oidc subject", account{Provider: "oidc", Identity: identity{ID: "01234567-89ab-cdef-0123-456789abcdef"}}, false},
+	} {
+		if got := isAdmin(&tt.a); got != tt.admin {
+			t.Errorf("%s: isAdmin = %v, want %v", tt.name, got, tt.admin)
+		}
+	}
+}
+
+func TestDebugVarsRequireAdmin(t *testing.T) {
+	app := newTestApp(t)
+	app.login(t)
+	if resp, _ := app.get(t, "/debug/vars"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("GET /debug/vars as a non-admin = %d, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+	app.get(t, "/logout")
+	if resp, _ := app.get(t, "/debug/vars"); resp.Request.URL.Path != "/" {
+		t.Errorf("signed out GET /debug/vars ended at %s", resp.Request.URL.Path)
+	}
+
+	saved := adminUsers
+	adminUsers = []string{app.heroku.User.ID}
+	defer func() { adminUsers = saved }()
+	resp, body := app.get(t, "/auth/heroku")
+	if resp.Request.URL.Path != "/debug/vars" || resp.StatusCode != http.StatusOK || !strings.Contains(body, "memstats") {
+		t.Errorf("signing in as an admin ended at %s with %d", resp.Request.URL.Path, resp.StatusCode)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	rf := &rotatingFile{path: path, maxBytes: 10, keep: 2}
+	for _, line := range []string{"one\n", "two\n", "three\n", "four\n"} {
+		if _, err := rf.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, want := range map[string]string{path: "four\n", path + ".1": "three\n", path + ".2": "one\ntwo\n"} {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != want {
+			t.Errorf("%s = %q, want %q", name, b, want)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("kept more than 2 rotated files")
+	}
+}
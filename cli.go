@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+
+	"golang.org/x/oauth2"
+)
+
+// runCommand runs the command line subcommand named by args[0], reporting
+// whether there was one.
+func runCommand(args []string) (bool, error) {
+	if len(args) == 0 {
+		return false, nil
+	}
+	switch args[0] {
+	case "login":
+		return true, runLogin(args[1:])
+	case "whoami":
+		return true, runWhoami(args[1:])
+	case "worker":
+		if dyno := getenv("DYNO"); !schedulerDyno(dyno, "worker") {
+			log.Printf("%s is not worker.1; leaving the job scheduler to it", dyno)
+			select {} // exiting would only get the dyno restarted
+		}
+		log.Print("running the job scheduler")
+		newScheduler().start(context.Background())
+		return true, nil
+	}
+	return false, nil
+}
+
+func defaultCredentialsPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = "."
+	}
+	return filepath.Join(dir, "heroku-oauth-example-go", "credentials.json")
+}
+
+func runLogin(args []string) error {
+	fs := flag.NewFlagSet("login", flag.ExitOnError)
+	port := fs.Int("port", 0, "loopback port registered in the OAuth client's redirect URL (0 picks any free port)")
+	path := fs.String("credentials", defaultCredentialsPath(), "file to store the token in")
+	fs.Parse(args)
+
+	l, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(*port)))
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	state, err := randomHex(16)
+	if err != nil {
+		return err
+	}
+	config := *oauthConfig
+	config.RedirectURL = "http://" + l.Addr().String() + "/callback"
+
+	type result struct {
+		code string
+		err  error
+	}
+	done := make(chan result, 1)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/callback" {
+			http.NotFound(w, r)
+			return
+		}
+		var res result
+		switch {
+		case r.FormValue("state") != state:
+			res.err = errors.New("invalid state token")
+		case r.FormValue("error") != "":
+			res.err = fmt.Errorf("authorization failed: %s %s", r.FormValue("error"), r.FormValue("error_description"))
+		default:
+			res.code = r.FormValue("code")
+		}
+		if res.err != nil {
+			http.Error(w, res.err.Error(), http.StatusBadRequest)
+		} else {
+			fmt.Fprint(w, `<html><body>Signed in. You can close this window.</body></html>`)
+		}
+		select {
+		case done <- res:
+		default:
+		}
+	})}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	url := config.AuthCodeURL(state)
+	fmt.Fprintf(os.Stderr, "Opening %s\nIf your browser does not open, visit the URL above.\n", url)
+	openBrowser(url)
+
+	res := <-done
+	if res.err != nil {
+		return res.err
+	}
+	ctx, cancel := outboundContext(context.Background(), exchangeTimeout)
+	defer cancel()
+	token, err := config.Exchange(ctx, res.code)
+	if err != nil {
+		return err
+	}
+	if err := saveCredentials(*path, token); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Token saved to %s\n", *path)
+	return nil
+}
+
+func runWhoami(args []string) error {
+	fs := flag.NewFlagSet("whoami", flag.ExitOnError)
+	path := fs.String("credentials", defaultCredentialsPath(), "file the token is stored in")
+	fs.Parse(args)
+
+	token, err := loadCredentials(*path)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := outboundContext(context.Background(), apiTimeout)
+	defer cancel()
+	src := oauthConfig.TokenSource(ctx, token)
+	id, err := identifyHeroku(ctx, oauth2.NewClient(ctx, src))
+	if err != nil {
+		return err
+	}
+	if t, err := src.Token(); err == nil && t.AccessToken != token.AccessToken {
+		if err := saveCredentials(*path, t); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("%s (%s)\n", id.Email, id.ID)
+	return nil
+}
+
+func saveCredentials(path string, token *oauth2.Token) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return writeJSONFile(path, token)
+}
+
+func loadCredentials(path string) (*oauth2.Token, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading credentials (run login first): %v", err)
+	}
+	var token oauth2.Token
+	if err := json.Unmarshal(b, &token); err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func openBrowser(url string) {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", url)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	default:
+		cmd = exec.Command("xdg-open", url)
+	}
+	cmd.Start()
+}
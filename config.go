@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/sessions"
+)
+
+var dotenvOnce sync.Once
+
+// getenv reads configuration, loading .env first in development mode.
+func getenv(key string) string {
+	dotenvOnce.Do(func() {
+		if os.Getenv("DEV_MODE") != "" {
+			loadDotEnv(".env")
+		}
+	})
+	return os.Getenv(key)
+}
+
+// devMode relaxes cookie security for working on the app over plain http.
+// It only serves localhost and refuses to start on a Heroku dyno.
+var devMode = getenv("DEV_MODE") != ""
+
+// loadDotEnv sets the KEY=value lines of path as environment variables,
+// leaving variables that are already set alone.
+func loadDotEnv(path string) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("loading %s: %v", path, err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		if !ok {
+			continue
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		if _, set := os.LookupEnv(key); !set {
+			os.Setenv(key, value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatalf("loading %s: %v", path, err)
+	}
+}
+
+var cookieSameSite = parseSameSite(getenvDefault("COOKIE_SAMESITE", "lax"))
+
+func parseSameSite(v string) string {
+	switch strings.ToLower(v) {
+	case "lax":
+		return "Lax"
+	case "strict":
+		return "Strict"
+	case "none":
+		return "None"
+	case "off":
+		return ""
+	}
+	log.Fatalf("COOKIE_SAMESITE: want lax, strict, none or off, got %q", v)
+	return ""
+}
+
+// configureCookies applies the cookie settings to the store's options.
+func configureCookies(o *sessions.Options) {
+	o.Path = getenvDefault("COOKIE_PATH", "/")
+	o.Domain = getenv("COOKIE_DOMAIN")
+	o.HttpOnly = true
+	o.Secure = !devMode
+	if cookieSameSite == "None" && !o.Secure {
+		log.Fatal("COOKIE_SAMESITE=none needs secure cookies and cannot be used in DEV_MODE")
+	}
+}
+
+// cookieAttributes adds SameSite to the session cookie, which the vendored
+// sessions package cannot set, and in development mode turns away requests
+// for any host but localhost.
+func cookieAttributes(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if devMode && !isLocalhost(r.Host) {
+			http.Error(w, "DEV_MODE only serves localhost", http.StatusForbidden)
+			return
+		}
+		sw := &sameSiteWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		sw.addSameSite()
+	})
+}
+
+func isLocalhost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.Trim(host, "[]")
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+type sameSiteWriter struct {
+	http.ResponseWriter
+	done bool
+}
+
+func (w *sameSiteWriter) addSameSite() {
+	if w.done || cookieSameSite == "" {
+		return
+	}
+	w.done = true
+	cookies := w.Header()["Set-Cookie"]
+	for i, c := range cookies {
+		if strings.HasPrefix(c, sessionName+"=") && !strings.Contains(strings.ToLower(c), "samesite=") {
+			cookies[i] = c + "; SameSite=" + cookieSameSite
+		}
+	}
+}
+
+func (w *sameSiteWriter) WriteHeader(code int) {
+	w.addSameSite()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *sameSiteWriter) Write(b []byte) (int, error) {
+	w.addSameSite()
+	return w.ResponseWriter.Write(b)
+}
+
+// checkDevMode stops development and mock mode from being used in production.
+func checkDevMode() error {
+	if devMode && os.Getenv("DYNO") != "" {
+		return fmt.Errorf("DEV_MODE cannot be used on a Heroku dyno (DYNO=%s)", os.Getenv("DYNO"))
+	}
+	if mockMode && os.Getenv("DYNO") != "" {
+		return fmt.Errorf("MOCK_MODE cannot be used on a Heroku dyno (DYNO=%s)", os.Getenv("DYNO"))
+	}
+	return nil
+}
+
+// printConfig writes the effective configuration with secrets redacted.
+func printConfig(w io.Writer) {
+	secret := func(v string) string {
+		if v == "" {
+			return "(unset)"
+		}
+		return "(redacted)"
+	}
+	var providerNames []string
+	for _, p := range sortedProviders() {
+		providerNames = append(providerNames, p.Name)
+	}
+	for _, kv := range [][2]string{
+		{"app URL", appURL},
+		{"mock mode", fmt.Sprint(mockMode)},
+		{"providers", strings.Join(providerNames, " ")},
+		{"Heroku OAuth client ID", oauthConfig.ClientID},
+		{"Heroku OAuth client secret", secret(oauthConfig.ClientSecret)},
+		{"Heroku OAuth scopes", strings.Join(oauthConfig.Scopes, " ")},
+		{"Heroku authorize URL", oauthConfig.Endpoint.AuthURL},
+		{"Heroku token URL", oauthConfig.Endpoint.TokenURL},
+		{"Heroku API URL", herokuAPIURL},
+		{"cookie name", sessionName},
+		{"cookie domain", store.Options.Domain},
+		{"cookie path", store.Options.Path},
+		{"cookie SameSite", cookieSameSite},
+		{"cookie secure", fmt.Sprint(store.Options.Secure)},
+		{"cookie keys", fmt.Sprintf("%d (redacted)", len(store.Codecs))},
+		{"session idle timeout", sessionIdleTimeout.String()},
+		{"session max age", sessionMaxAge.String()},
+		{"session remember max age", sessionRememberMaxAge.String()},
+		{"access policy", fmt.Sprintf("domains=%v users=%v teams=%v", accessRules.Domains, accessRules.Users, accessRules.Teams)},
+		{"admin users", strings.Join(adminUsers, " ")},
+		{"webhook secret", secret(webhookSecret)},
+		{"SSO salt", secret(ssoSalt)},
+		{"add-on password", secret(addonPassword)},
+		{"user store", fmt.Sprint(users != nil)},
+		{"jobs scheduler", schedulerMode},
+		{"JWT signing keys", fmt.Sprintf("%d (redacted)", len(jwtKeys))},
+		{"JWT lifetime", jwtTTL.String()},
+		{"HTTP timeouts", fmt.Sprintf("exchange=%s api=%s overall=%s", exchangeTimeout, apiTimeout, httpTimeout)},
+	} {
+		fmt.Fprintf(w, "%-26s %s\n", kv[0], kv[1])
+	}
+}
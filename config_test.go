@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/sessions"
+)
+
+func TestLoadDotEnv(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".env")
+	ioutil.WriteFile(path, []byte(`# comment
+DOTENV_PLAIN=one
+export DOTENV_EXPORTED = two
+DOTENV_QUOTED="three = 3"
+DOTENV_SET=from-file
+not a setting
+`), 0600)
+	for _, k := range []string{"DOTENV_PLAIN", "DOTENV_EXPORTED", "DOTENV_QUOTED"} {
+		t.Setenv(k, "")
+		os.Unsetenv(k)
+	}
+	t.Setenv("DOTENV_SET", "from-env")
+	loadDotEnv(path)
+	for k, want := range map[string]string{
+		"DOTENV_PLAIN":    "one",
+		"DOTENV_EXPORTED": "two",
+		"DOTENV_QUOTED":   "three = 3",
+		"DOTENV_SET":      "from-env",
+	} {
+		if got := os.Getenv(k); got != want {
+			t.Errorf("%s = %q, want %q", k, got, want)
+		}
+	}
+}
+
+func TestCookieAttributes(t *testing.T) {
+	h := cookieAttributes(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		opts := &sessions.Options{}
+		configureCookies(opts)
+		http.SetCookie(w, sessions.NewCookie(sessionName, "value", opts))
+		http.SetCookie(w, &http.Cookie{Name: "other", Value: "value"})
+	}))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	cookies := rec.Header()["Set-Cookie"]
+	if len(cookies) != 2 {
+		t.Fatalf("Set-Cookie = %q", cookies)
+	}
+	for _, want := range []string{"HttpOnly", "Secure", "Path=/", "SameSite=Lax"} {
+		if !strings.Contains(cookies[0], want) {
+			t.Errorf("session cookie %q is missing %s", cookies[0], want)
+		}
+	}
+	if strings.Contains(cookies[1], "SameSite") {
+		t.Errorf("other cookie was changed: %q", cookies[1])
+	}
+}
+
+func TestDevMode(t *testing.T) {
+	saved := devMode
+	t.Cleanup(func() { devMode = saved })
+	devMode = true
+
+	h := cookieAttributes(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for host, want := range map[string]int{
+		"localhost:5000":    http.StatusOK,
+		"127.0.0.1:5000":    http.StatusOK,
+		"[::1]:5000":        http.StatusOK,
+		"example.com":       http.StatusForbidden,
+		"localhost.evil.io": http.StatusForbidden,
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = host
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Errorf("Host %s = %d, want %d", host, rec.Code, want)
+		}
+	}
+
+	opts := &sessions.Options{}
+	configureCookies(opts)
+	if opts.Secure {
+		t.Error("DEV_MODE cookies are secure")
+	}
+	t.Setenv("DYNO", "web.1")
+	if err := checkDevMode(); err == nil {
+		t.Error("DEV_MODE allowed on a dyno")
+	}
+}
+
+func TestPrintConfigRedactsSecrets(t *testing.T) {
+	saved := oauthConfig.ClientSecret
+	t.Cleanup(func() { oauthConfig.ClientSecret = saved })
+	oauthConfig.ClientSecret = "very-secret-value"
+	var buf bytes.Buffer
+	printConfig(&buf)
+	if strings.Contains(buf.String(), "very-secret-value") {
+		t.Error("config output contains the client secret")
+	}
+	if !strings.Contains(buf.String(), "(redacted)") {
+		t.Errorf("config output = %s", buf.String())
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// Session cookies decoded per key ("current", "previous-1", ...) show how
+// many sessions are still on old keys.
+var (
+	sessionKeyDecodes = expvar.NewMap("session_key_decodes")
+	sessionsReencoded = expvar.NewInt("sessions_reencoded")
+)
+
+// cookieKeyPairs returns the session cookie keys as hash/encryption pairs,
+// newest first. COOKIE_KEYS holds space separated "secret:encrypt" pairs; only
+// the first is used to encode cookies and the rest are kept so sessions issued
+// under previous keys still decode. Without it COOKIE_SECRET and
+// COOKIE_ENCRYPT form the only pair.
+func cookieKeyPairs() ([][]byte, error) {
+	keys := getenv("COOKIE_KEYS")
+	if keys == "" {
+		keys = getenv("COOKIE_SECRET") + ":" + getenv("COOKIE_ENCRYPT")
+	}
+	return parseCookieKeys(keys)
+}
+
+// parseCookieKeys rejects pairs without both keys: an empty secret would
+// let anyone sign a session and a missing encryption key would leave
+// tokens readable in the cookie.
+func parseCookieKeys(keys string) ([][]byte, error) {
+	var pairs [][]byte
+	for n, pair := range strings.Fields(keys) {
+		hash, block, _ := strings.Cut(pair, ":")
+		if hash == "" {
+			return nil, fmt.Errorf("pair %d has no secret", n+1)
+		}
+		switch len(block) {
+		case 16, 24, 32:
+		default:
+			return nil, fmt.Errorf("pair %d needs an encryption key of 16, 24 or 32 bytes, got %d", n+1, len(block))
+		}
+		pairs = append(pairs, []byte(hash), []byte(block))
+	}
+	if len(pairs) == 0 {
+		return nil, errors.New("no keys configured")
+	}
+	return pairs, nil
+}
+
+// newCookieStore builds the session store from the configured keys. If they
+// can't be used the store gets random keys, so nothing can forge a session,
+// along with the error for main to refuse to serve on.
+func newCookieStore() (*sessions.CookieStore, error) {
+	pairs, err := cookieKeyPairs()
+	if err != nil {
+		return sessions.NewCookieStore(securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32)), err
+	}
+	return sessions.NewCookieStore(pairs...), nil
+}
+
+// reencodeSessions rewrites session cookies still encoded with a previous key
+// using the current one, so that old keys can be dropped after a rotation
+// without signing anyone out.
+func reencodeSessions(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c, err := r.Cookie(sessionName); err == nil {
+			reencodeSession(w, c)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func reencodeSession(w http.ResponseWriter, c *http.Cookie) {
+	for i, codec := range store.Codecs {
+		values := map[interface{}]interface{}{}
+		if err := codec.Decode(c.Name, c.Value, &values); err != nil {
+			continue
+		}
+		sessionKeyDecodes.Add(keyLabel(i), 1)
+		if i == 0 {
+			return
+		}
+		encoded, err := securecookie.EncodeMulti(c.Name, values, store.Codecs...)
+		if err != nil {
+			log.Printf("re-encoding session: %v", err)
+			return
+		}
+		http.SetCookie(w, sessions.NewCookie(c.Name, encoded, store.Options))
+		sessionsReencoded.Add(1)
+		return
+	}
+}
+
+func keyLabel(i int) string {
+	if i == 0 {
+		return "current"
+	}
+	return "previous-" + strconv.Itoa(i)
+}
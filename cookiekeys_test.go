@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+func TestParseCookieKeys(t *testing.T) {
+	pairs, err := parseCookieKeys("new-secret:new-encrypt-key1 old-secret:old-encrypt-key1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pairs) != 4 {
+		t.Fatalf("got %d keys, want 4", len(pairs))
+	}
+	if string(pairs[0]) != "new-secret" || string(pairs[1]) != "new-encrypt-key1" {
+		t.Errorf("first pair = %q, %q", pairs[0], pairs[1])
+	}
+	if string(pairs[2]) != "old-secret" || string(pairs[3]) != "old-encrypt-key1" {
+		t.Errorf("second pair = %q, %q", pairs[2], pairs[3])
+	}
+
+	for _, keys := range []string{"", ":", "secret", "secret:", ":encrypt-key-0001", "secret:short", "good:encrypt-key-0001 old-secret"} {
+		if _, err := parseCookieKeys(keys); err == nil {
+			t.Errorf("parseCookieKeys(%q) accepted missing or empty keys", keys)
+		}
+	}
+}
+
+func TestUnconfiguredStoreRejectsForgedCookies(t *testing.T) {
+	s, err := newCookieStore()
+	if err == nil {
+		t.Skip("cookie keys are configured in this environment")
+	}
+	forged, err := securecookie.EncodeMulti(sessionName, map[interface{}]interface{}{"k": "v"}, securecookie.New([]byte{}, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: sessionName, Value: forged})
+	if sess, _ := s.Get(req, sessionName); sess.Values["k"] != nil {
+		t.Error("a cookie signed with an empty key was accepted")
+	}
+}
+
+func TestReencodeSessions(t *testing.T) {
+	oldKey, oldBlock := securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(16)
+	newKey, newBlock := securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(16)
+
+	savedStore := store
+	defer func() { store = savedStore }()
+
+	store = sessions.NewCookieStore(oldKey, oldBlock)
+	old, err := securecookie.EncodeMulti(sessionName, map[interface{}]interface{}{"k": "v"}, store.Codecs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store = sessions.NewCookieStore(newKey, newBlock, oldKey, oldBlock)
+	var seen string
+	h := reencodeSessions(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s, err := store.Get(r, sessionName)
+		if err != nil {
+			t.Fatalf("decoding session under the old key: %v", err)
+		}
+		seen, _ = s.Values["k"].(string)
+	}))
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: sessionName, Value: old})
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if seen != "v" {
+		t.Errorf("handler saw %q, want v", seen)
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("got %d cookies, want the re-encoded session", len(cookies))
+	}
+	values := map[interface{}]interface{}{}
+	if err := securecookie.New(newKey, newBlock).Decode(sessionName, cookies[0].Value, &values); err != nil {
+		t.Fatalf("re-encoded cookie does not decode with the current key: %v", err)
+	}
+	if values["k"] != "v" {
+		t.Errorf("re-encoded values = %v", values)
+	}
+}
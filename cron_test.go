@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSchedule(t *testing.T) {
+	at := func(s string) time.Time {
+		tm, err := time.Parse("2006-01-02 15:04 Mon", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	for _, tt := range []struct {
+		expr string
+		time string
+		want bool
+	}{
+		{"0 20 * * *", "2026-10-19 20:00 Mon", true},
+		{"0 20 * * *", "2026-10-19 20:01 Mon", false},
+		{"*/15 * * * *", "2026-10-19 08:45 Mon", true},
+		{"*/15 * * * *", "2026-10-19 08:46 Mon", false},
+		{"0 8 * * 1-5", "2026-10-18 08:00 Sun", false},
+		{"0 8 * * 1-5", "2026-10-19 08:00 Mon", true},
+		{"0 0 * * 7", "2026-10-18 00:00 Sun", true},
+		{"30 4 1,15 * *", "2026-10-15 04:30 Thu", true},
+		{"30 4 1 * 1", "2026-10-19 04:30 Mon", true}, // either day field matches
+		{"5/20 * * * *", "2026-10-19 04:25 Mon", true},
+	} {
+		s, err := parseSchedule(tt.expr)
+		if err != nil {
+			t.Errorf("parseSchedule(%q): %v", tt.expr, err)
+			continue
+		}
+		if got := s.matches(at(tt.time)); got != tt.want {
+			t.Errorf("%q matches %s = %v, want %v", tt.expr, tt.time, got, tt.want)
+		}
+	}
+}
+
+func TestScheduleErrors(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "5-1 * * * *", "*/0 * * * *", "a * * * *"} {
+		if _, err := parseSchedule(expr); err == nil {
+			t.Errorf("parseSchedule(%q) succeeded", expr)
+		}
+	}
+}
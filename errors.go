@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// callbackError is a failed sign in as explained to the user. Details of
+// the underlying error are only logged.
+type callbackError struct {
+	Kind    string // short identifier used in logs and the audit trail
+	Status  int
+	Title   string
+	Message string
+}
+
+var (
+	errCallbackDenied = callbackError{"access_denied", http.StatusForbidden,
+		"Access was not granted", "You chose not to allow this app access to your account. Sign in again if that was a mistake."}
+	errCallbackState = callbackError{"invalid_state", http.StatusBadRequest,
+		"Sign in expired", "This sign in attempt could not be verified, possibly because it was started in another window or took too long."}
+	errCallbackCode = callbackError{"invalid_code", http.StatusBadRequest,
+		"Sign in expired", "The authorization code was invalid or has expired. Please sign in again."}
+	errCallbackClient = callbackError{"invalid_client", http.StatusInternalServerError,
+		"Sign in is misconfigured", "This app's OAuth client credentials were rejected. Please contact the app's maintainers."}
+	errCallbackOutage = callbackError{"provider_unavailable", http.StatusBadGateway,
+		"Sign in is unavailable", "The identity provider could not be reached or returned an error. Please try again in a few minutes."}
+	errCallbackRequest = callbackError{"invalid_request", http.StatusBadRequest,
+		"Sign in failed", "The identity provider could not complete the sign in request."}
+	errCallbackInternal = callbackError{"internal_error", http.StatusInternalServerError,
+		"Sign in failed", "Something went wrong while signing you in. Please try again."}
+)
+
+var callbackErrorTemplate = template.Must(template.New("callback-error").Parse(`<html><body>
+<h1>{{.Title}}</h1>
+<p>{{.Message}}</p>
+<p><a href="{{.RetryURL}}">Try again</a></p>
+</body></html>`))
+
+func (e callbackError) render(w http.ResponseWriter, p *provider) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(e.Status)
+	callbackErrorTemplate.Execute(w, struct {
+		callbackError
+		RetryURL string
+	}{e, "/auth/" + p.Name})
+}
+
+// providerCallbackError maps the error parameter a provider redirects back
+// with. See https://tools.ietf.org/html/rfc6749#section-4.1.2.1
+func providerCallbackError(code string) callbackError {
+	switch code {
+	case "access_denied":
+		return errCallbackDenied
+	case "server_error", "temporarily_unavailable":
+		return errCallbackOutage
+	case "unauthorized_client":
+		return errCallbackClient
+	}
+	return errCallbackRequest
+}
+
+// exchangeError classifies an error from oauth2.Config.Exchange. The
+// vendored oauth2 package reports token endpoint failures only as text of
+// the form "oauth2: cannot fetch token: <status>\nResponse: <body>".
+func exchangeError(err error) callbackError {
+	const prefix = "oauth2: cannot fetch token: "
+	msg := err.Error()
+	if !strings.HasPrefix(msg, prefix) {
+		return errCallbackOutage
+	}
+	msg = strings.TrimPrefix(msg, prefix)
+	status, _ := strconv.Atoi(strings.SplitN(msg, " ", 2)[0])
+	var body struct {
+		Error string `json:"error"`
+		ID    string `json:"id"` // Heroku style errors
+	}
+	if i := strings.Index(msg, "\nResponse: "); i >= 0 {
+		json.Unmarshal([]byte(msg[i+len("\nResponse: "):]), &body)
+	}
+	switch {
+	case body.Error == "invalid_grant":
+		return errCallbackCode
+	case body.Error == "invalid_client" || body.Error == "unauthorized_client":
+		return errCallbackClient
+	case status >= 500 || status == 0:
+		return errCallbackOutage
+	case status == http.StatusUnauthorized:
+		return errCallbackClient
+	}
+	return errCallbackCode
+}
+
+// logCallbackError records the details behind e, which are not shown to
+// the user.
+func logCallbackError(p *provider, e callbackError, err error) {
+	if err != nil {
+		log.Printf("%s callback failed (%s): %v", p.Name, e.Kind, err)
+	} else {
+		log.Printf("%s callback failed (%s)", p.Name, e.Kind)
+	}
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fakeHeroku stands in for id.heroku.com and api.heroku.com. It implements
+// the authorize, token and account endpoints and can be told to fail any of
+// them.
+type fakeHeroku struct {
+	*httptest.Server
+
+	ClientID     string
+	ClientSecret string
+	User         fakeUser
+	Teams        []fakeTeam
+
+	mu            sync.Mutex
+	expiresIn     int
+	rotateRefresh bool
+	fail          map[string]int
+	delay         map[string]time.Duration
+	codes         map[string]bool
+	access        map[string]bool
+	refresh       map[string]bool
+	refreshes     int
+	seq           int
+	appCalls      []string
+}
+
+type fakeTeam struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Role string `json:"role"`
+	// Enterprise names the enterprise account the team belongs to, if any.
+	Enterprise string   `json:"-"`
+	Apps       []string `json:"-"`
+}
+
+type fakeUser struct {
+	ID            string    `json:"id"`
+	Email         string    `json:"email"`
+	Name          string    `json:"name"`
+	Verified      bool      `json:"verified"`
+	AllowTracking bool      `json:"allow_tracking"`
+	Beta          bool      `json:"beta"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+func newFakeHeroku() *fakeHeroku {
+	f := &fakeHeroku{
+		ClientID:     "fake-client-id",
+		ClientSecret: "fake-client-secret",
+		User:         fakeUser{ID: "01234567-89ab-cdef-0123-456789abcdef", Email: "user@example.com", Name: "Example User", Verified: true, CreatedAt: time.Date(2015, 3, 1, 12, 0, 0, 0, time.UTC)},
+		expiresIn:    3600,
+		fail:         map[string]int{},
+		delay:        map[string]time.Duration{},
+		codes:        map[string]bool{},
+		access:       map[string]bool{},
+		refresh:      map[string]bool{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oauth/authorize", f.handleAuthorize)
+	mux.HandleFunc("/oauth/token", f.handleToken)
+	mux.HandleFunc("/account", f.handleAccount)
+	mux.HandleFunc("/teams", f.handleTeams)
+	mux.HandleFunc("/teams/", f.handleTeam)
+	mux.HandleFunc("/enterprise-accounts", f.handleEnterprise)
+	mux.HandleFunc("/enterprise-accounts/", f.handleEnterprise)
+	mux.HandleFunc("/apps/", f.handleApps)
+	f.Server = httptest.NewServer(mux)
+	return f
+}
+
+// failWith makes endpoint ("authorize", "token", "refresh", "account", "teams", ...)
+// respond with status until cleared with a status of 0.
+func (f *fakeHeroku) failWith(endpoint string, status int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if status == 0 {
+		delete(f.fail, endpoint)
+		return
+	}
+	f.fail[endpoint] = status
+}
+
+// setExpiresIn sets the lifetime in seconds of access tokens issued from now on.
+func (f *fakeHeroku) setExpiresIn(seconds int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.expiresIn = seconds
+}
+
+// setRotateRefresh makes each refresh grant invalidate the refresh token it
+// used and issue a new one.
+func (f *fakeHeroku) setRotateRefresh(rotate bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rotateRefresh = rotate
+}
+
+func (f *fakeHeroku) refreshCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.refreshes
+}
+
+// setDelay makes endpoint take d to respond, or until the client gives up.
+func (f *fakeHeroku) setDelay(endpoint string, d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.delay[endpoint] = d
+}
+
+func (f *fakeHeroku) failure(endpoint string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.fail[endpoint]
+}
+
+func (f *fakeHeroku) wait(r *http.Request, endpoint string) {
+	f.mu.Lock()
+	d := f.delay[endpoint]
+	f.mu.Unlock()
+	select {
+	case <-time.After(d):
+	case <-r.Context().Done():
+	}
+}
+
+// newToken returns a unique token as long as Heroku's, so session cookie
+// sizes in tests are realistic.
+func (f *fakeHeroku) newToken(prefix string) string {
+	f.seq++
+	t := fmt.Sprintf("%s-%d-", prefix, f.seq)
+	return t + strings.Repeat("x", 65-len(t))
+}
+
+func (f *fakeHeroku) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	redirect, err := url.Parse(r.FormValue("redirect_uri"))
+	if err != nil || r.FormValue("client_id") != f.ClientID {
+		http.Error(w, "invalid client", http.StatusBadRequest)
+		return
+	}
+	q := redirect.Query()
+	q.Set("state", r.FormValue("state"))
+	if f.failure("authorize") != 0 {
+		q.Set("error", "access_denied")
+		q.Set("error_description", "The user denied access")
+	} else {
+		f.mu.Lock()
+		code := f.newToken("code")
+		f.codes[code] = true
+		f.mu.Unlock()
+		q.Set("code", code)
+	}
+	redirect.RawQuery = q.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (f *fakeHeroku) handleToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		id, secret = r.FormValue("client_id"), r.FormValue("client_secret")
+	}
+	if id != f.ClientID || secret != f.ClientSecret {
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client")
+		return
+	}
+
+	grant := r.FormValue("grant_type")
+	endpoint := "token"
+	if grant == "refresh_token" {
+		endpoint = "refresh"
+	}
+	f.wait(r, endpoint)
+	if status := f.failure(endpoint); status != 0 {
+		writeOAuthError(w, status, "server_error")
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var refresh string
+	switch grant {
+	case "authorization_code":
+		code := r.FormValue("code")
+		if !f.codes[code] {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_grant")
+			return
+		}
+		delete(f.codes, code)
+		refresh = f.newToken("refresh")
+		f.refresh[refresh] = true
+	case "refresh_token":
+		refresh = r.FormValue("refresh_token")
+		if !f.refresh[refresh] {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_grant")
+			return
+		}
+		f.refreshes++
+		if f.rotateRefresh {
+			delete(f.refresh, refresh)
+			refresh = f.newToken("refresh")
+			f.refresh[refresh] = true
+		}
+	default:
+		writeOAuthError(w, http.StatusBadRequest, "unsupported_grant_type")
+		return
+	}
+	access := f.newToken("access")
+	f.access[access] = true
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token":  access,
+		"refresh_token": refresh,
+		"token_type":    "Bearer",
+		"expires_in":    f.expiresIn,
+		"user_id":       f.User.ID,
+	})
+}
+
+func writeOAuthError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": code})
+}
+
+// authorized reports whether r carries a bearer token issued by f.
+func (f *fakeHeroku) authorized(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.access[token]
+}
+
+func (f *fakeHeroku) handleAccount(w http.ResponseWriter, r *http.Request) {
+	f.wait(r, "account")
+	if status := f.failure("account"); status != 0 {
+		http.Error(w, `{"id":"unavailable"}`, status)
+		return
+	}
+	if !f.authorized(r) {
+		http.Error(w, `{"id":"unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.Method == "PATCH" {
+		var patch struct {
+			Name          *string `json:"name"`
+			AllowTracking *bool   `json:"allow_tracking"`
+			Beta          *bool   `json:"beta"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			http.Error(w, `{"id":"bad_request"}`, http.StatusBadRequest)
+			return
+		}
+		if patch.Name != nil {
+			f.User.Name = *patch.Name
+		}
+		if patch.AllowTracking != nil {
+			f.User.AllowTracking = *patch.AllowTracking
+		}
+		if patch.Beta != nil {
+			f.User.Beta = *patch.Beta
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(f.User)
+}
+
+func (f *fakeHeroku) handleTeams(w http.ResponseWriter, r *http.Request) {
+	if status := f.failure("teams"); status != 0 {
+		http.Error(w, `{"id":"unavailable"}`, status)
+		return
+	}
+	if !f.authorized(r) {
+		http.Error(w, `{"id":"unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+	teams := f.Teams
+	if teams == nil {
+		teams = []fakeTeam{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(teams)
+}
+
+// handleTeam serves a team's members, of which the user is the only one, and
+// apps.
+func (f *fakeHeroku) handleTeam(w http.ResponseWriter, r *http.Request) {
+	if !f.authorized(r) {
+		http.Error(w, `{"id":"unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/teams/"), "/")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, t := range f.Teams {
+		if len(parts) != 2 || t.Name != parts[0] {
+			continue
+		}
+		var v interface{}
+		switch parts[1] {
+		case "members":
+			v = []map[string]interface{}{{"email": f.User.Email, "role": t.Role, "user": map[string]string{"id": f.User.ID, "name": f.User.Name}}}
+		case "apps":
+			apps := []map[string]string{}
+			for _, a := range t.Apps {
+				apps = append(apps, map[string]string{"name": a, "web_url": "https://" + a + ".herokuapp.com/"})
+			}
+			v = apps
+		default:
+			continue
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+		return
+	}
+	http.Error(w, `{"id":"not_found"}`, http.StatusNotFound)
+}
+
+// handleEnterprise serves the enterprise accounts named by the user's teams,
+// with the user as their only member.
+func (f *fakeHeroku) handleEnterprise(w http.ResponseWriter, r *http.Request) {
+	if !f.authorized(r) {
+		http.Error(w, `{"id":"unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/enterprise-accounts"), "/"), "/")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	v := []interface{}{}
+	seen := map[string]bool{}
+	for _, t := range f.Teams {
+		switch {
+		case t.Enterprise == "":
+		case parts[0] == "":
+			if !seen[t.Enterprise] {
+				seen[t.Enterprise] = true
+				v = append(v, map[string]string{"id": t.Enterprise, "name": t.Enterprise})
+			}
+		case len(parts) == 2 && parts[0] == t.Enterprise && parts[1] == "teams":
+			v = append(v, t)
+		case len(parts) == 2 && parts[0] == t.Enterprise && parts[1] == "members" && !seen[t.Enterprise]:
+			seen[t.Enterprise] = true
+			v = append(v, map[string]interface{}{"user": map[string]string{"email": f.User.Email}, "permissions": []map[string]string{{"name": "view"}}})
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// handleApps accepts any app request, recording its method and path.
+func (f *fakeHeroku) handleApps(w http.ResponseWriter, r *http.Request) {
+	if status := f.failure("apps"); status != 0 {
+		http.Error(w, `{"id":"unavailable"}`, status)
+		return
+	}
+	if !f.authorized(r) {
+		http.Error(w, `{"id":"unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+	f.mu.Lock()
+	f.appCalls = append(f.appCalls, r.Method+" "+r.URL.Path)
+	f.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte("{}"))
+}
+
+func (f *fakeHeroku) calls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.appCalls...)
+}
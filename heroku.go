@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+var herokuAPIURL = getenvDefault("HEROKU_API_URL", "https://api.heroku.com")
+
+// herokuGet decodes the Platform API resource at path into v.
+func herokuGet(client *http.Client, path string, v interface{}) error {
+	return herokuDo(client, "GET", path, nil, v)
+}
+
+// herokuDo sends body, if any, as JSON to the Platform API and decodes the
+// response into v, if any.
+func herokuDo(client *http.Client, method, path string, body, v interface{}) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, herokuAPIURL+path, r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.heroku+json; version=3") // See https://devcenter.heroku.com/articles/platform-api-reference#clients
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// apiError reports a failed Platform API call, with a plain explanation when
+// the API has been failing long enough for its circuit to open.
+func apiError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errCircuitOpen) {
+		http.Error(w, "The Heroku API is unavailable right now. Please try again in a minute.", http.StatusServiceUnavailable)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadGateway)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// Deadlines for outbound calls, from HTTP_TIMEOUT, EXCHANGE_TIMEOUT and
+// API_TIMEOUT.
+var (
+	httpTimeout     = durationEnv("HTTP_TIMEOUT", 30*time.Second)
+	exchangeTimeout = durationEnv("EXCHANGE_TIMEOUT", 10*time.Second)
+	apiTimeout      = durationEnv("API_TIMEOUT", 15*time.Second)
+)
+
+// httpTransport is shared by every outbound call: token exchanges, refreshes
+// and API requests. It honours HTTPS_PROXY and friends, and trusts the
+// certificates in HTTP_CA_BUNDLE in addition to the system roots.
+var httpTransport = newHTTPTransport(getenv("HTTP_CA_BUNDLE"))
+
+func durationEnv(key string, def time.Duration) time.Duration {
+	v := getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("%s: %v", key, err)
+	}
+	return d
+}
+
+func newHTTPTransport(caBundle string) *http.Transport {
+	t := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: httpTimeout,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConnsPerHost:   10,
+	}
+	if caBundle != "" {
+		pem, err := ioutil.ReadFile(caBundle)
+		if err != nil {
+			log.Fatalf("HTTP_CA_BUNDLE: %v", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			log.Fatalf("HTTP_CA_BUNDLE: no certificates found in %s", caBundle)
+		}
+		t.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return t
+}
+
+// outboundContext derives a context for outbound calls from parent, usually
+// a request's context, limited to timeout. The oauth2 package picks the
+// shared client up from it, and requests made through that client are
+// cancelled along with the context.
+func outboundContext(parent context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	client := &http.Client{Transport: contextTransport{ctx: ctx, base: apiTransport}, Timeout: httpTimeout}
+	return context.WithValue(ctx, oauth2.HTTPClient, client), cancel
+}
+
+// contextTransport attaches ctx to each request. The vendored oauth2 package
+// builds its requests without a context, so this is what lets deadlines and
+// cancellation reach token exchanges and refreshes.
+type contextTransport struct {
+	ctx  context.Context
+	base http.RoundTripper
+}
+
+func (t contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.base.RoundTrip(req.WithContext(t.ctx))
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestOutboundTimeouts(t *testing.T) {
+	savedExchange, savedAPI := exchangeTimeout, apiTimeout
+	defer func() { exchangeTimeout, apiTimeout = savedExchange, savedAPI }()
+	exchangeTimeout, apiTimeout = 200*time.Millisecond, 200*time.Millisecond
+
+	for _, endpoint := range []string{"token", "account"} {
+		t.Run(endpoint, func(t *testing.T) {
+			app := newTestApp(t)
+			app.heroku.setDelay(endpoint, time.Minute)
+
+			start := time.Now()
+			resp, body := app.get(t, "/auth/heroku")
+			if d := time.Since(start); d > 5*time.Second {
+				t.Errorf("login with a hung %s endpoint took %v", endpoint, d)
+			}
+			if resp.StatusCode != http.StatusBadGateway {
+				t.Errorf("login with a hung %s endpoint = %d, want %d: %s", endpoint, resp.StatusCode, http.StatusBadGateway, body)
+			}
+		})
+	}
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"golang.org/x/oauth2"
+)
+
+// maxJobRuns is how much run history is kept per job.
+const maxJobRuns = 20
+
+// job is a recurring action a user has scheduled against one of their apps.
+// It runs with the owner's stored refresh token.
+type job struct {
+	ID          string    `json:"id"`
+	OwnerID     string    `json:"owner_id"`
+	OwnerEmail  string    `json:"owner_email"`
+	Schedule    string    `json:"schedule"`
+	Action      string    `json:"action"` // "scale" or "restart"
+	App         string    `json:"app"`
+	ProcessType string    `json:"process_type"`
+	Quantity    int       `json:"quantity,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	Runs        []jobRun  `json:"runs"`
+}
+
+type jobRun struct {
+	Slot     time.Time     `json:"slot"`
+	Started  time.Time     `json:"started"`
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+}
+
+func (j job) describe() string {
+	switch j.Action {
+	case "scale":
+		return fmt.Sprintf("scale %s %s to %d", j.App, j.ProcessType, j.Quantity)
+	case "restart":
+		if j.ProcessType == "" {
+			return fmt.Sprintf("restart %s", j.App)
+		}
+		return fmt.Sprintf("restart %s %s", j.App, j.ProcessType)
+	}
+	return j.Action
+}
+
+// failing reports whether j's most recent run failed.
+func (j job) failing() bool {
+	return len(j.Runs) > 0 && j.Runs[len(j.Runs)-1].Error != ""
+}
+
+func (j job) validate() error {
+	if _, err := parseSchedule(j.Schedule); err != nil {
+		return err
+	}
+	if j.App == "" {
+		return errors.New("app is required")
+	}
+	switch j.Action {
+	case "scale":
+		if j.ProcessType == "" || j.Quantity < 0 {
+			return errors.New("scaling needs a process type and a quantity of 0 or more")
+		}
+	case "restart":
+	default:
+		return fmt.Errorf("unknown action %q", j.Action)
+	}
+	return nil
+}
+
+// jobStore keeps jobs in a JSON file.
+type jobStore struct {
+	path string
+
+	mu      sync.Mutex
+	loaded  bool
+	version fileVersion // of path when last read
+	jobs    map[string]*job
+}
+
+var jobs = &jobStore{path: getenvDefault("JOB_STORE", "jobs.json")}
+
+func (s *jobStore) load() error {
+	changed, err := jsonFileChanged(s.path, &s.version)
+	if err != nil {
+		return err
+	}
+	if s.loaded && !changed {
+		return nil
+	}
+	s.jobs = map[string]*job{}
+	s.loaded = false
+	if err := readJSONFile(s.path, &s.jobs); err != nil {
+		return err
+	}
+	s.loaded = true
+	return nil
+}
+
+// list returns copies of the jobs owned by ownerID, or of every job if
+// ownerID is empty, oldest first.
+func (s *jobStore) list(ownerID string) ([]job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	var out []job
+	for _, j := range s.jobs {
+		if ownerID == "" || j.OwnerID == ownerID {
+			c := *j
+			c.Runs = append([]jobRun(nil), j.Runs...)
+			out = append(out, c)
+		}
+	}
+	sort.Slice(out, func(i, k int) bool { return out[i].CreatedAt.Before(out[k].CreatedAt) })
+	return out, nil
+}
+
+func (s *jobStore) add(j job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return err
+	}
+	s.jobs[j.ID] = &j
+	return writeJSONFile(s.path, s.jobs)
+}
+
+// delete removes the job with id if it belongs to ownerID.
+func (s *jobStore) delete(id, ownerID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return false, err
+	}
+	j, ok := s.jobs[id]
+	if !ok || j.OwnerID != ownerID {
+		return false, nil
+	}
+	delete(s.jobs, id)
+	return true, writeJSONFile(s.path, s.jobs)
+}
+
+func (s *jobStore) recordRun(id string, run jobRun) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return err
+	}
+	j, ok := s.jobs[id]
+	if !ok {
+		return nil // deleted while running
+	}
+	j.Runs = append(j.Runs, run)
+	if len(j.Runs) > maxJobRuns {
+		j.Runs = j.Runs[len(j.Runs)-maxJobRuns:]
+	}
+	return writeJSONFile(s.path, s.jobs)
+}
+
+// jobLocker makes sure each scheduled run of a job happens once, however
+// many processes run the scheduler.
+type jobLocker interface {
+	// claim reports whether the caller won the right to run jobID for slot.
+	claim(jobID string, slot time.Time) (bool, error)
+}
+
+// fileLocker claims runs by exclusively creating lock files in dir. It
+// protects processes sharing a filesystem; dynos do not, which is why only
+// one of them runs the scheduler (see schedulerDyno).
+type fileLocker struct {
+	dir string
+}
+
+func (l fileLocker) claim(jobID string, slot time.Time) (bool, error) {
+	if err := os.MkdirAll(l.dir, 0700); err != nil {
+		return false, err
+	}
+	name := filepath.Join(l.dir, jobID+"-"+slot.UTC().Format("200601021504")+".lock")
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	fmt.Fprintf(f, "%d\n", os.Getpid())
+	return true, f.Close()
+}
+
+// sweep removes lock files for slots older than a day.
+func (l fileLocker) sweep(now time.Time) {
+	names, _ := filepath.Glob(filepath.Join(l.dir, "*.lock"))
+	for _, name := range names {
+		if fi, err := os.Stat(name); err == nil && now.Sub(fi.ModTime()) > 24*time.Hour {
+			os.Remove(name)
+		}
+	}
+}
+
+// scheduler runs due jobs once a minute.
+type scheduler struct {
+	jobs   *jobStore
+	locker jobLocker
+	run    func(ctx context.Context, j job) error
+}
+
+func newScheduler() *scheduler {
+	dir := getenvDefault("JOB_LOCK_DIR", filepath.Join(os.TempDir(), "heroku-oauth-example-go-locks"))
+	return &scheduler{jobs: jobs, locker: fileLocker{dir: dir}, run: runJob}
+}
+
+// start runs the scheduler until ctx is done.
+func (s *scheduler) start(ctx context.Context) {
+	slot := time.Now().UTC().Truncate(time.Minute) // cron expressions are in UTC
+	for {
+		// Step from the previous slot rather than the clock so none is
+		// skipped, and don't wait for runs that outlast their minute.
+		slot = slot.Add(time.Minute)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(slot)):
+		}
+		go s.tick(ctx, slot)
+		if l, ok := s.locker.(fileLocker); ok && slot.Minute() == 0 {
+			l.sweep(slot)
+		}
+	}
+}
+
+// tick runs every job due in slot's minute and waits for them to finish.
+func (s *scheduler) tick(ctx context.Context, slot time.Time) {
+	all, err := s.jobs.list("")
+	if err != nil {
+		log.Printf("loading jobs: %v", err)
+		return
+	}
+	var wg sync.WaitGroup
+	for _, j := range all {
+		sched, err := parseSchedule(j.Schedule)
+		if err != nil || !sched.matches(slot) {
+			continue
+		}
+		ok, err := s.locker.claim(j.ID, slot)
+		if err != nil {
+			log.Printf("claiming job %s: %v", j.ID, err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func(j job) {
+			defer wg.Done()
+			s.runOnce(ctx, j, slot)
+		}(j)
+	}
+	wg.Wait()
+}
+
+func (s *scheduler) runOnce(ctx context.Context, j job, slot time.Time) {
+	ctx, cancel := outboundContext(ctx, time.Minute)
+	defer cancel()
+	run := jobRun{Slot: slot, Started: time.Now()}
+	err := s.run(ctx, j)
+	run.Duration = time.Since(run.Started)
+	outcome := auditSuccess
+	if err != nil {
+		run.Error = err.Error()
+		outcome = auditFailure
+		log.Printf("job %s (%s) failed: %v", j.ID, j.describe(), err)
+	}
+	owner := &account{Provider: "heroku", Identity: identity{ID: j.OwnerID, Email: j.OwnerEmail}}
+	audits.record(nil, owner, auditEvent{Action: "job." + j.Action, Target: j.App + "/" + j.ProcessType, Outcome: outcome, Detail: run.Error})
+	if err := s.jobs.recordRun(j.ID, run); err != nil {
+		log.Printf("recording run of job %s: %v", j.ID, err)
+	}
+}
+
+// runJob performs j as its owner.
+func runJob(ctx context.Context, j job) error {
+	if users == nil {
+		return errors.New("offline access is not configured")
+	}
+	src, err := users.tokenSource(ctx, j.OwnerID)
+	if err != nil {
+		return err
+	}
+	client := oauth2.NewClient(ctx, src)
+	app := "/apps/" + url.PathEscape(j.App)
+	switch j.Action {
+	case "scale":
+		return herokuDo(client, "PATCH", app+"/formation/"+url.PathEscape(j.ProcessType), map[string]int{"quantity": j.Quantity}, nil)
+	case "restart":
+		if j.ProcessType == "" {
+			return herokuDo(client, "DELETE", app+"/dynos", nil, nil)
+		}
+		return herokuDo(client, "DELETE", app+"/dynos/"+url.PathEscape(j.ProcessType), nil, nil)
+	}
+	return fmt.Errorf("unknown action %q", j.Action)
+}
+
+// schedulerMode is where the scheduler runs: "web" (the default) starts it
+// in the web process, "worker" leaves it to a worker command sharing this
+// process's filesystem and "off" disables it.
+var schedulerMode = strings.ToLower(getenvDefault("JOBS_SCHEDULER", "web"))
+
+// schedulerDyno reports whether the dyno named dyno (Heroku's DYNO, empty
+// elsewhere) should run the scheduler for processType. Dynos don't share a
+// filesystem for fileLocker to work across, so only the first one does and
+// scaling up doesn't start more schedulers.
+func schedulerDyno(dyno, processType string) bool {
+	return dyno == "" || dyno == processType+".1"
+}
+
+func handleJobs(w http.ResponseWriter, r *http.Request, s *sessions.Session, a *account) {
+	if a.Provider != "heroku" {
+		http.Error(w, a.label()+" is not a Heroku account", http.StatusBadRequest)
+		return
+	}
+	list, err := jobs.list(a.Identity.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprint(w, `<html><body>`)
+	writeAccountBar(w, s, a)
+	fmt.Fprint(w, `<h1>Scheduled jobs</h1>`)
+	if users == nil {
+		fmt.Fprint(w, `<p><strong>Offline access is not configured, so jobs cannot run.</strong></p>`)
+	}
+	for _, j := range list {
+		fmt.Fprintf(w, `<h2>%s</h2><p><code>%s</code> <form method="post" action="/jobs/%s/delete" style="display:inline">%s<button>Delete</button></form></p>`,
+			html.EscapeString(j.describe()), html.EscapeString(j.Schedule), url.PathEscape(j.ID), csrfInput(s))
+		if j.failing() {
+			fmt.Fprintf(w, `<p style="color:red">Last run failed: %s</p>`, html.EscapeString(j.Runs[len(j.Runs)-1].Error))
+		}
+		fmt.Fprint(w, `<table><tr><th>Scheduled</th><th>Took</th><th>Result</th></tr>`)
+		for i := len(j.Runs) - 1; i >= 0; i-- {
+			run := j.Runs[i]
+			result := "ok"
+			if run.Error != "" {
+				result = run.Error
+			}
+			fmt.Fprintf(w, `<tr><td>%s</td><td>%s</td><td>%s</td></tr>`, run.Slot.Format(time.RFC1123), run.Duration.Round(time.Millisecond), html.EscapeString(result))
+		}
+		fmt.Fprint(w, `</table>`)
+	}
+	fmt.Fprint(w, `<h2>New job</h2><form method="post" action="/jobs">`+csrfInput(s)+
+		`<p>Schedule (cron, UTC) <input name="schedule" placeholder="0 20 * * *"></p>`+
+		`<p><select name="action"><option value="scale">Scale</option><option value="restart">Restart</option></select>`+
+		` app <input name="app"> process type <input name="process_type" placeholder="web"> quantity <input name="quantity" size="3"></p>`+
+		`<p><button>Schedule</button></p></form></body></html>`)
+}
+
+func handleJobDelete(w http.ResponseWriter, r *http.Request, s *sessions.Session, a *account) {
+	id := r.PathValue("id")
+	ok, err := jobs.delete(id, a.Identity.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		handleNotFound(w, r)
+		return
+	}
+	audits.record(r, a, auditEvent{Action: "job.delete", Target: id, Outcome: auditSuccess})
+	http.Redirect(w, r, "/jobs", http.StatusFound)
+}
+
+func handleJobCreate(w http.ResponseWriter, r *http.Request, s *sessions.Session, a *account) {
+	if a.Provider != "heroku" {
+		http.Error(w, a.label()+" is not a Heroku account", http.StatusBadRequest)
+		return
+	}
+	if users == nil {
+		http.Error(w, "Offline access is not configured", http.StatusServiceUnavailable)
+		return
+	}
+	if _, err := users.user(a.Identity.ID); err != nil {
+		http.Error(w, "Sign in again to allow jobs to run while you are away", http.StatusBadRequest)
+		return
+	}
+	id, err := randomHex(8)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	action := r.FormValue("action")
+	quantity, err := strconv.Atoi(strings.TrimSpace(r.FormValue("quantity")))
+	if err != nil && action == "scale" {
+		// A blank quantity must not become a scale to 0.
+		http.Error(w, "Scaling needs a quantity of 0 or more", http.StatusBadRequest)
+		return
+	}
+	j := job{
+		ID:          id,
+		OwnerID:     a.Identity.ID,
+		OwnerEmail:  a.Identity.Email,
+		Schedule:    strings.TrimSpace(r.FormValue("schedule")),
+		Action:      action,
+		App:         strings.TrimSpace(r.FormValue("app")),
+		ProcessType: strings.TrimSpace(r.FormValue("process_type")),
+		Quantity:    quantity,
+		CreatedAt:   time.Now(),
+	}
+	if err := j.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := jobs.add(j); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	audits.record(r, a, auditEvent{Action: "job.create", Target: j.ID, Outcome: auditSuccess, Detail: j.Schedule + " " + j.describe()})
+	http.Redirect(w, r, "/jobs", http.StatusFound)
+}
+
+// writeJobFailures renders a notice for a's jobs whose last run failed.
+func writeJobFailures(w http.ResponseWriter, a *account) {
+	list, err := jobs.list(a.Identity.ID)
+	if err != nil {
+		return
+	}
+	for _, j := range list {
+		if j.failing() {
+			fmt.Fprintf(w, `<p style="color:red">Scheduled job "%s" failed. <a href="/jobs">See jobs</a></p>`, html.EscapeString(j.describe()))
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSchedulerRunsDueJobsOnce(t *testing.T) {
+	savedAudits := audits
+	audits = &auditLog{sink: ioutil.Discard, max: 100}
+	defer func() { audits = savedAudits }()
+
+	dir := t.TempDir()
+	store := &jobStore{path: filepath.Join(dir, "jobs.json")}
+	for _, j := range []job{
+		{ID: "due", Schedule: "0 20 * * *", Action: "restart", App: "a"},
+		{ID: "later", Schedule: "0 8 * * *", Action: "restart", App: "b"},
+		{ID: "broken", Schedule: "0 20 * * *", Action: "restart", App: "c"},
+	} {
+		if err := store.add(j); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var mu sync.Mutex
+	ran := map[string]int{}
+	run := func(ctx context.Context, j job) error {
+		mu.Lock()
+		defer mu.Unlock()
+		ran[j.ID]++
+		if j.ID == "broken" {
+			return errors.New("boom")
+		}
+		return nil
+	}
+	// Two schedulers sharing a lock directory stand in for two processes.
+	locker := fileLocker{dir: filepath.Join(dir, "locks")}
+	a := &scheduler{jobs: store, locker: locker, run: run}
+	b := &scheduler{jobs: store, locker: locker, run: run}
+	slot := time.Date(2026, 10, 19, 20, 0, 0, 0, time.UTC)
+	var wg sync.WaitGroup
+	for _, s := range []*scheduler{a, b} {
+		wg.Add(1)
+		go func(s *scheduler) {
+			defer wg.Done()
+			s.tick(context.Background(), slot)
+		}(s)
+	}
+	wg.Wait()
+
+	if ran["due"] != 1 || ran["broken"] != 1 || ran["later"] != 0 {
+		t.Errorf("runs = %v, want due and broken once each", ran)
+	}
+	list, err := store.list("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, j := range list {
+		switch j.ID {
+		case "due":
+			if len(j.Runs) != 1 || j.failing() {
+				t.Errorf("due job history = %+v", j.Runs)
+			}
+		case "broken":
+			if !j.failing() || j.Runs[0].Error != "boom" {
+				t.Errorf("broken job history = %+v", j.Runs)
+			}
+		}
+	}
+}
+
+func TestJobStoreSharedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jobs.json")
+	web, worker := &jobStore{path: path}, &jobStore{path: path}
+	if _, err := worker.list(""); err != nil {
+		t.Fatal(err)
+	}
+
+	// The worker sees jobs added after it first read the file, and its run
+	// history doesn't overwrite them.
+	if err := web.add(job{ID: "first", Schedule: "* * * * *", Action: "restart", App: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if list, _ := worker.list(""); len(list) != 1 {
+		t.Fatalf("worker sees %d jobs, want 1", len(list))
+	}
+	if err := web.add(job{ID: "second", Schedule: "* * * * *", Action: "restart", App: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := worker.recordRun("first", jobRun{Slot: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	list, err := web.list("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 {
+		t.Fatalf("web sees %d jobs after the worker's run, want 2", len(list))
+	}
+	for _, j := range list {
+		if j.ID == "first" && len(j.Runs) != 1 {
+			t.Errorf("web sees %d runs of the first job, want 1", len(j.Runs))
+		}
+	}
+}
+
+func TestRunJob(t *testing.T) {
+	app := newTestApp(t)
+	s, err := newUserStore(filepath.Join(t.TempDir(), "users.json"), strings.Repeat("ab", 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := users
+	users = s
+	defer func() { users = saved }()
+	app.login(t)
+
+	for _, j := range []job{
+		{OwnerID: app.heroku.User.ID, Action: "scale", App: "example", ProcessType: "web", Quantity: 0},
+		{OwnerID: app.heroku.User.ID, Action: "restart", App: "example", ProcessType: "worker"},
+	} {
+		if err := runJob(context.Background(), j); err != nil {
+			t.Errorf("%s: %v", j.describe(), err)
+		}
+	}
+	want := "PATCH /apps/example/formation/web,DELETE /apps/example/dynos/worker"
+	if got := strings.Join(app.heroku.calls(), ","); got != want {
+		t.Errorf("API calls = %s, want %s", got, want)
+	}
+}
+
+func TestJobValidate(t *testing.T) {
+	for _, j := range []job{
+		{Schedule: "bad", Action: "restart", App: "a"},
+		{Schedule: "* * * * *", Action: "restart"},
+		{Schedule: "* * * * *", Action: "scale", App: "a"},
+		{Schedule: "* * * * *", Action: "destroy", App: "a"},
+	} {
+		if err := j.validate(); err == nil {
+			t.Errorf("validate(%+v) succeeded", j)
+		}
+	}
+}
+
+func TestJobCreate(t *testing.T) {
+	app := newTestApp(t)
+	savedUsers, savedJobs := users, jobs
+	defer func() { users, jobs = savedUsers, savedJobs }()
+	users, _ = newUserStore(filepath.Join(t.TempDir(), "users.json"), strings.Repeat("ab", 32))
+	jobs = &jobStore{path: filepath.Join(t.TempDir(), "jobs.json")}
+	app.login(t)
+
+	post := func(quantity string) int {
+		t.Helper()
+		return app.postForm(t, "/jobs", url.Values{
+			"schedule": {"0 20 * * *"}, "action": {"scale"}, "app": {"example"}, "process_type": {"web"}, "quantity": {quantity},
+		}).StatusCode
+	}
+	for _, q := range []string{"", "two"} {
+		if status := post(q); status != http.StatusBadRequest {
+			t.Errorf("scale to %q = %d, want %d", q, status, http.StatusBadRequest)
+		}
+	}
+	if list, _ := jobs.list(""); len(list) != 0 {
+		t.Fatalf("scheduled %v", list)
+	}
+	if status := post("0"); status != http.StatusOK {
+		t.Errorf("scale to 0 = %d", status)
+	}
+	if list, _ := jobs.list(""); len(list) != 1 || list[0].Quantity != 0 {
+		t.Errorf("jobs = %+v", list)
+	}
+}
+
+func TestSchedulerDyno(t *testing.T) {
+	for _, tt := range []struct {
+		dyno, processType string
+		want              bool
+	}{
+		{"", "web", true},
+		{"web.1", "web", true},
+		{"worker.1", "worker", true},
+		{"web.2", "web", false},
+		{"web.11", "web", false},
+		{"run.1", "web", false},
+		{"worker.1", "web", false},
+	} {
+		if got := schedulerDyno(tt.dyno, tt.processType); got != tt.want {
+			t.Errorf("schedulerDyno(%q, %q) = %v, want %v", tt.dyno, tt.processType, got, tt.want)
+		}
+	}
+}
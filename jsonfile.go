@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// readJSONFile decodes the JSON file at path into v, leaving v untouched if
+// the file does not exist.
+func readJSONFile(path string, v interface{}) error {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// writeJSONFile atomically replaces path with v encoded as JSON, readable
+// only by the current user.
+func writeJSONFile(path string, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	// A temp file of its own, so processes sharing path can't clobber
+	// each other's half written copies.
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// fileVersion identifies a version of a file by its size and modification
+// time. The zero value is a missing file.
+type fileVersion struct {
+	size    int64
+	modTime time.Time
+}
+
+// jsonFileChanged reports whether path is no longer at version *v, updating
+// *v. Stores check it before every operation so they pick up writes made by
+// other processes sharing the file, such as a worker.
+func jsonFileChanged(path string, v *fileVersion) (bool, error) {
+	var cur fileVersion
+	fi, err := os.Stat(path)
+	if err == nil {
+		cur = fileVersion{fi.Size(), fi.ModTime()}
+	} else if !os.IsNotExist(err) {
+		return false, err
+	}
+	changed := cur != *v
+	*v = cur
+	return changed, nil
+}
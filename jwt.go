@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// jwtKey signs tokens for downstream services: RSA keys with RS256 and
+// Ed25519 keys with EdDSA. Its ID is the RFC 7638 thumbprint of its
+// public key.
+type jwtKey struct {
+	id     string
+	alg    string
+	signer crypto.Signer
+	jwk    map[string]string
+}
+
+var (
+	// jwtKeys are loaded from JWT_SIGNING_KEYS, PEM encoded PKCS#8 private
+	// keys with the newest first. The first signs new tokens and all are
+	// published at /.well-known/jwks.json, so a key can be added after the
+	// first ahead of rotating to it and kept there until the tokens it
+	// signed have expired.
+	jwtKeys     = mustLoadJWTKeys(getenv("JWT_SIGNING_KEYS"))
+	jwtTTL      = durationEnv("JWT_TTL", 5*time.Minute)
+	jwtAudience = getenv("JWT_AUDIENCE")
+)
+
+func mustLoadJWTKeys(s string) []*jwtKey {
+	keys, err := parseJWTKeys(s)
+	if err != nil {
+		log.Fatalf("JWT_SIGNING_KEYS: %v", err)
+	}
+	return keys
+}
+
+func parseJWTKeys(s string) ([]*jwtKey, error) {
+	var keys []*jwtKey
+	rest := []byte(s)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("key %d: %v", len(keys)+1, err)
+		}
+		key, err := newJWTKey(parsed)
+		if err != nil {
+			return nil, fmt.Errorf("key %d: %v", len(keys)+1, err)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 && strings.TrimSpace(s) != "" {
+		return nil, errors.New("no PEM encoded keys found")
+	}
+	return keys, nil
+}
+
+func newJWTKey(private interface{}) (*jwtKey, error) {
+	k := &jwtKey{}
+	var thumbprint string
+	switch key := private.(type) {
+	case *rsa.PrivateKey:
+		if key.N.BitLen() < 2048 {
+			return nil, errors.New("RSA keys must be at least 2048 bits")
+		}
+		k.alg, k.signer = "RS256", key
+		k.jwk = map[string]string{
+			"kty": "RSA",
+			"n":   b64(key.N.Bytes()),
+			"e":   b64(big.NewInt(int64(key.E)).Bytes()),
+		}
+		thumbprint = fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, k.jwk["e"], k.jwk["n"])
+	case ed25519.PrivateKey:
+		k.alg, k.signer = "EdDSA", key
+		k.jwk = map[string]string{
+			"kty": "OKP",
+			"crv": "Ed25519",
+			"x":   b64(key.Public().(ed25519.PublicKey)),
+		}
+		thumbprint = fmt.Sprintf(`{"crv":"Ed25519","kty":"OKP","x":"%s"}`, k.jwk["x"])
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", private)
+	}
+	sum := sha256.Sum256([]byte(thumbprint)) // See https://www.rfc-editor.org/rfc/rfc7638
+	k.id = b64(sum[:])
+	k.jwk["kid"], k.jwk["alg"], k.jwk["use"] = k.id, k.alg, "sig"
+	return k, nil
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// sign returns the compact JWS of claims. See https://www.rfc-editor.org/rfc/rfc7515
+func (k *jwtKey) sign(claims interface{}) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": k.alg, "kid": k.id, "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	input := b64(header) + "." + b64(payload)
+	var sig []byte
+	switch k.alg {
+	case "RS256":
+		sum := sha256.Sum256([]byte(input))
+		sig, err = k.signer.Sign(rand.Reader, sum[:], crypto.SHA256)
+	case "EdDSA":
+		sig, err = k.signer.Sign(rand.Reader, []byte(input), crypto.Hash(0))
+	}
+	if err != nil {
+		return "", err
+	}
+	return input + "." + b64(sig), nil
+}
+
+// jwtClaims describe a Heroku user to downstream services.
+type jwtClaims struct {
+	Issuer    string          `json:"iss"`
+	Subject   string          `json:"sub"`
+	Audience  string          `json:"aud,omitempty"`
+	IssuedAt  int64           `json:"iat"`
+	NotBefore int64           `json:"nbf"`
+	Expires   int64           `json:"exp"`
+	ID        string          `json:"jti"`
+	Email     string          `json:"email"`
+	Teams     []jwtMembership `json:"teams"`
+}
+
+type jwtMembership struct {
+	Name string `json:"name"`
+	Role string `json:"role"`
+}
+
+func newJWTClaims(a *account, teams []team, now time.Time) (jwtClaims, error) {
+	id, err := randomHex(16)
+	if err != nil {
+		return jwtClaims{}, err
+	}
+	c := jwtClaims{
+		Issuer:    appURL,
+		Subject:   a.Identity.ID,
+		Audience:  jwtAudience,
+		IssuedAt:  now.Unix(),
+		NotBefore: now.Unix(),
+		Expires:   now.Add(jwtTTL).Unix(),
+		ID:        id,
+		Email:     a.Identity.Email,
+		Teams:     []jwtMembership{},
+	}
+	for _, t := range teams {
+		c.Teams = append(c.Teams, jwtMembership{Name: t.Name, Role: t.Role})
+	}
+	return c, nil
+}
+
+// handleJWKS publishes the public halves of jwtKeys.
+func handleJWKS(w http.ResponseWriter, r *http.Request) {
+	if len(jwtKeys) == 0 {
+		handleNotFound(w, r)
+		return
+	}
+	keys := []map[string]string{}
+	for _, k := range jwtKeys {
+		keys = append(keys, k.jwk)
+	}
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(w, http.StatusOK, map[string]interface{}{"keys": keys})
+}
+
+// handleJWT mints a token for the current Heroku account with its current
+// team memberships.
+func handleJWT(w http.ResponseWriter, r *http.Request, s *sessions.Session, a *account) {
+	if len(jwtKeys) == 0 {
+		handleNotFound(w, r)
+		return
+	}
+	ctx, cancel := outboundContext(r.Context(), apiTimeout)
+	defer cancel()
+	client, err := herokuClient(ctx, a)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	teams, err := userTeams(client)
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+	claims, err := newJWTClaims(a, teams, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	token, err := jwtKeys[0].sign(claims)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	audits.record(r, a, auditEvent{Action: "jwt.issue", Target: jwtKeys[0].id, Outcome: auditSuccess, Detail: claims.ID})
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"token":      token,
+		"token_type": "Bearer",
+		"expires_in": int64(jwtTTL / time.Second),
+	})
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func pemKey(t *testing.T, key interface{}) string {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+}
+
+func testJWTKeys(t *testing.T) (edPEM, rsaPEM string) {
+	t.Helper()
+	_, ed, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rk, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pemKey(t, ed), pemKey(t, rk)
+}
+
+func TestParseJWTKeys(t *testing.T) {
+	edPEM, rsaPEM := testJWTKeys(t)
+	keys, err := parseJWTKeys(edPEM + rsaPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0].alg != "EdDSA" || keys[1].alg != "RS256" || keys[0].id == keys[1].id {
+		t.Fatalf("keys = %+v", keys)
+	}
+	again, _ := parseJWTKeys(rsaPEM)
+	if again[0].id != keys[1].id {
+		t.Error("key ID is not stable")
+	}
+
+	small, _ := rsa.GenerateKey(rand.Reader, 1024)
+	for name, s := range map[string]string{
+		"garbage":    "not a key",
+		"small RSA":  pemKey(t, small),
+		"not PKCS#8": string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(small)})),
+	} {
+		if _, err := parseJWTKeys(s); err == nil {
+			t.Errorf("%s was accepted", name)
+		}
+	}
+	if keys, err := parseJWTKeys(""); err != nil || len(keys) != 0 {
+		t.Errorf("empty config = %v, %v", keys, err)
+	}
+}
+
+// verifyJWT checks token against the published key set and returns its claims.
+func verifyJWT(t *testing.T, app *testApp, token string) (header map[string]string, claims jwtClaims) {
+	t.Helper()
+	_, body := app.get(t, "/.well-known/jwks.json")
+	var jwks struct{ Keys []map[string]string }
+	if err := json.Unmarshal([]byte(body), &jwks); err != nil {
+		t.Fatalf("jwks: %v: %s", err, body)
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("token %q is not a compact JWS", token)
+	}
+	decode := func(s string) []byte {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	json.Unmarshal(decode(parts[0]), &header)
+	json.Unmarshal(decode(parts[1]), &claims)
+	input, sig := []byte(parts[0]+"."+parts[1]), decode(parts[2])
+	for _, k := range jwks.Keys {
+		if k["kid"] != header["kid"] {
+			continue
+		}
+		switch header["alg"] {
+		case "EdDSA":
+			if !ed25519.Verify(ed25519.PublicKey(decode(k["x"])), input, sig) {
+				t.Fatal("bad EdDSA signature")
+			}
+		case "RS256":
+			pub := &rsa.PublicKey{N: new(big.Int).SetBytes(decode(k["n"])), E: int(new(big.Int).SetBytes(decode(k["e"])).Int64())}
+			sum := sha256.Sum256(input)
+			if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], sig); err != nil {
+				t.Fatalf("bad RS256 signature: %v", err)
+			}
+		default:
+			t.Fatalf("alg = %q", header["alg"])
+		}
+		return header, claims
+	}
+	t.Fatalf("kid %q is not published", header["kid"])
+	return nil, claims
+}
+
+func fetchJWT(t *testing.T, app *testApp) string {
+	t.Helper()
+	req, _ := http.NewRequest("POST", app.URL+"/token", nil)
+	req.Header.Set(csrfHeader, app.csrfToken(t))
+	resp, err := app.client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Token     string `json:"token"`
+		ExpiresIn int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /token = %d: %v", resp.StatusCode, err)
+	}
+	if resp.Header.Get("Cache-Control") != "no-store" || body.ExpiresIn != int64(jwtTTL/time.Second) {
+		t.Errorf("token response is cacheable or has expires_in %d", body.ExpiresIn)
+	}
+	return body.Token
+}
+
+func TestJWTIssueAndRotate(t *testing.T) {
+	app := newTestApp(t)
+	saved := jwtKeys
+	t.Cleanup(func() { jwtKeys = saved })
+	jwtKeys = nil
+	if resp, _ := app.get(t, "/.well-known/jwks.json"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("jwks without keys = %d", resp.StatusCode)
+	}
+
+	edPEM, rsaPEM := testJWTKeys(t)
+	jwtKeys, _ = parseJWTKeys(edPEM + rsaPEM)
+	app.heroku.Teams = []fakeTeam{{Name: "ops", Role: "admin"}, {Name: "web", Role: "member"}}
+	app.login(t)
+
+	header, claims := verifyJWT(t, app, fetchJWT(t, app))
+	if header["alg"] != "EdDSA" || header["kid"] != jwtKeys[0].id {
+		t.Errorf("header = %v", header)
+	}
+	now := time.Now().Unix()
+	if claims.Subject != app.heroku.User.ID || claims.Email != app.heroku.User.Email || claims.Issuer != appURL ||
+		claims.Expires <= now || claims.Expires > now+int64(jwtTTL/time.Second)+1 || claims.ID == "" {
+		t.Errorf("claims = %+v", claims)
+	}
+	if len(claims.Teams) != 2 || claims.Teams[0] != (jwtMembership{Name: "ops", Role: "admin"}) {
+		t.Errorf("teams = %+v", claims.Teams)
+	}
+
+	// Rotating puts the RSA key first; tokens from both keys still verify.
+	old := fetchJWT(t, app)
+	jwtKeys, _ = parseJWTKeys(rsaPEM + edPEM)
+	if header, _ := verifyJWT(t, app, fetchJWT(t, app)); header["alg"] != "RS256" {
+		t.Errorf("rotated token alg = %s", header["alg"])
+	}
+	verifyJWT(t, app, old)
+}
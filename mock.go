@@ -0,0 +1,350 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mockMode serves the Heroku provider from canned users and fixture data in
+// this process, for demos and working offline. It refuses to start on a
+// Heroku dyno.
+var mockMode = getenv("MOCK_MODE") != ""
+
+// mockHost is the made-up host the token endpoint and Platform API are
+// served on. Requests to it never leave the process.
+const mockHost = "heroku.mock"
+
+//go:embed mockdata
+var mockData embed.FS
+
+var mockAuthorizePage = template.Must(template.ParseFS(mockData, "mockdata/authorize.html"))
+
+// mockServer is the in-process Heroku while mock mode is on.
+var mockServer *mockHeroku
+
+func init() {
+	if mockMode {
+		enableMock(newMockHeroku())
+	}
+}
+
+// enableMock points the Heroku provider and API client at m.
+func enableMock(m *mockHeroku) {
+	mockServer = m
+	oauthConfig.Endpoint.AuthURL = "/mock/authorize"
+	oauthConfig.Endpoint.TokenURL = "http://" + mockHost + "/oauth/token"
+	oauthConfig.RedirectURL = "/auth/heroku/callback"
+	herokuAPIURL = "http://" + mockHost
+	apiTransport.base = &mockTransport{handler: m.routes(), next: apiTransport.base}
+}
+
+// mockTransport answers requests for mockHost with handler.
+type mockTransport struct {
+	handler http.Handler
+	next    http.RoundTripper
+}
+
+func (t *mockTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != mockHost {
+		return t.next.RoundTrip(req)
+	}
+	rec := httptest.NewRecorder()
+	t.handler.ServeHTTP(rec, req)
+	resp := rec.Result()
+	resp.Request = req
+	return resp, nil
+}
+
+type mockUser struct {
+	ID                  string          `json:"id"`
+	Email               string          `json:"email"`
+	Name                string          `json:"name"`
+	Verified            bool            `json:"verified"`
+	TwoFactor           bool            `json:"two_factor_authentication"`
+	AllowTracking       bool            `json:"allow_tracking"`
+	Beta                bool            `json:"beta"`
+	CreatedAt           time.Time       `json:"created_at"`
+	LastLogin           *time.Time      `json:"last_login"`
+	DefaultOrganization json.RawMessage `json:"default_organization"`
+}
+
+type mockApp struct {
+	Name  string `json:"name"`
+	Owner struct {
+		ID string `json:"id"`
+	} `json:"owner"`
+	raw json.RawMessage
+}
+
+type mockFormation struct {
+	Type     string `json:"type"`
+	Quantity int    `json:"quantity"`
+	Size     string `json:"size"`
+	Command  string `json:"command"`
+}
+
+// mockHeroku holds the fixtures and the grants issued against them. Changes
+// made through the API last until the process exits.
+type mockHeroku struct {
+	mu        sync.Mutex
+	users     []*mockUser
+	apps      []*mockApp
+	formation map[string][]*mockFormation
+	releases  map[string]json.RawMessage
+	codes     map[string]string // code to user ID
+	tokens    map[string]string // access or refresh token to user ID
+}
+
+func newMockHeroku() *mockHeroku {
+	m := &mockHeroku{codes: map[string]string{}, tokens: map[string]string{}}
+	var apps []json.RawMessage
+	for name, v := range map[string]interface{}{
+		"users.json":     &m.users,
+		"apps.json":      &apps,
+		"formation.json": &m.formation,
+		"releases.json":  &m.releases,
+	} {
+		b, err := mockData.ReadFile("mockdata/" + name)
+		if err == nil {
+			err = json.Unmarshal(b, v)
+		}
+		if err != nil {
+			log.Fatalf("loading mock %s: %v", name, err)
+		}
+	}
+	for _, raw := range apps {
+		a := &mockApp{raw: raw}
+		if err := json.Unmarshal(raw, a); err != nil {
+			log.Fatalf("loading mock apps.json: %v", err)
+		}
+		m.apps = append(m.apps, a)
+	}
+	return m
+}
+
+func (m *mockHeroku) routes() http.Handler {
+	rt := newRouter()
+	rt.handleFunc("POST", "/oauth/token", m.handleToken)
+	rt.handleFunc("GET", "/account", m.withUser(m.handleAccount))
+	rt.handleFunc("PATCH", "/account", m.withUser(m.handleAccount))
+	rt.handleFunc("GET", "/teams", m.withUser(func(w http.ResponseWriter, r *http.Request, u *mockUser) {
+		writeJSON(w, http.StatusOK, []struct{}{})
+	}))
+	rt.handleFunc("GET", "/apps", m.withUser(m.handleApps))
+	rt.handleFunc("GET", "/apps/{app}", m.withApp(m.handleApp))
+	rt.handleFunc("GET", "/apps/{app}/formation", m.withApp(m.handleFormation))
+	rt.handleFunc("PATCH", "/apps/{app}/formation/{type}", m.withApp(m.handleFormation))
+	rt.handleFunc("GET", "/apps/{app}/releases", m.withApp(m.handleReleases))
+	rt.handleFunc("DELETE", "/apps/{app}/dynos", m.withApp(m.handleRestart))
+	rt.handleFunc("DELETE", "/apps/{app}/dynos/{type}", m.withApp(m.handleRestart))
+	return rt
+}
+
+func mockError(w http.ResponseWriter, status int, id string) {
+	writeJSON(w, status, map[string]string{"id": id, "message": "mock: " + id})
+}
+
+func (m *mockHeroku) user(id string) (*mockUser, bool) {
+	for _, u := range m.users {
+		if u.ID == id {
+			return u, true
+		}
+	}
+	return nil, false
+}
+
+func (m *mockHeroku) issue(userID string) (string, error) {
+	token, err := randomHex(16)
+	if err != nil {
+		return "", err
+	}
+	m.tokens[token] = userID
+	return token, nil
+}
+
+// handleToken implements the authorization_code and refresh_token grants.
+func (m *mockHeroku) handleToken(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var userID string
+	switch r.FormValue("grant_type") {
+	case "authorization_code":
+		userID = m.codes[r.FormValue("code")]
+		delete(m.codes, r.FormValue("code"))
+	case "refresh_token":
+		userID = m.tokens[r.FormValue("refresh_token")]
+	}
+	if userID == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+	access, err := m.issue(userID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+	refresh := r.FormValue("refresh_token")
+	if refresh == "" {
+		if refresh, err = m.issue(userID); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token":  access,
+		"refresh_token": refresh,
+		"token_type":    "Bearer",
+		"expires_in":    28800,
+		"user_id":       userID,
+		"scope":         strings.Join(oauthConfig.Scopes, " "),
+	})
+}
+
+func (m *mockHeroku) withUser(h func(http.ResponseWriter, *http.Request, *mockUser)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		u, ok := m.user(m.tokens[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")])
+		if !ok {
+			mockError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		h(w, r, u)
+	}
+}
+
+// withApp finds the {app} owned by the signed in user.
+func (m *mockHeroku) withApp(h func(http.ResponseWriter, *http.Request, *mockApp)) http.HandlerFunc {
+	return m.withUser(func(w http.ResponseWriter, r *http.Request, u *mockUser) {
+		for _, a := range m.apps {
+			if a.Name == r.PathValue("app") && a.Owner.ID == u.ID {
+				h(w, r, a)
+				return
+			}
+		}
+		mockError(w, http.StatusNotFound, "not_found")
+	})
+}
+
+func (m *mockHeroku) handleAccount(w http.ResponseWriter, r *http.Request, u *mockUser) {
+	if r.Method == "PATCH" {
+		var patch struct {
+			Name          *string `json:"name"`
+			AllowTracking *bool   `json:"allow_tracking"`
+			Beta          *bool   `json:"beta"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			mockError(w, http.StatusBadRequest, "bad_request")
+			return
+		}
+		if patch.Name != nil {
+			u.Name = *patch.Name
+		}
+		if patch.AllowTracking != nil {
+			u.AllowTracking = *patch.AllowTracking
+		}
+		if patch.Beta != nil {
+			u.Beta = *patch.Beta
+		}
+	}
+	writeJSON(w, http.StatusOK, u)
+}
+
+func (m *mockHeroku) handleApps(w http.ResponseWriter, r *http.Request, u *mockUser) {
+	apps := []json.RawMessage{}
+	for _, a := range m.apps {
+		if a.Owner.ID == u.ID {
+			apps = append(apps, a.raw)
+		}
+	}
+	writeJSON(w, http.StatusOK, apps)
+}
+
+func (m *mockHeroku) handleApp(w http.ResponseWriter, r *http.Request, a *mockApp) {
+	writeJSON(w, http.StatusOK, a.raw)
+}
+
+func (m *mockHeroku) handleFormation(w http.ResponseWriter, r *http.Request, a *mockApp) {
+	formation := m.formation[a.Name]
+	if r.Method != "PATCH" {
+		writeJSON(w, http.StatusOK, formation)
+		return
+	}
+	var patch struct {
+		Quantity *int    `json:"quantity"`
+		Size     *string `json:"size"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		mockError(w, http.StatusBadRequest, "bad_request")
+		return
+	}
+	for _, f := range formation {
+		if f.Type != r.PathValue("type") {
+			continue
+		}
+		if patch.Quantity != nil {
+			f.Quantity = *patch.Quantity
+		}
+		if patch.Size != nil {
+			f.Size = *patch.Size
+		}
+		writeJSON(w, http.StatusOK, f)
+		return
+	}
+	mockError(w, http.StatusNotFound, "not_found")
+}
+
+func (m *mockHeroku) handleReleases(w http.ResponseWriter, r *http.Request, a *mockApp) {
+	writeJSON(w, http.StatusOK, m.releases[a.Name])
+}
+
+func (m *mockHeroku) handleRestart(w http.ResponseWriter, r *http.Request, a *mockApp) {
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// handleAuthorize is the sign in page /auth/heroku sends browsers to in
+// mock mode. Picking a user sends them back to the callback with a code.
+func (m *mockHeroku) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	redirect := r.FormValue("redirect_uri")
+	if redirect != oauthConfig.RedirectURL {
+		http.Error(w, "Unknown redirect_uri", http.StatusBadRequest)
+		return
+	}
+	if r.Method == "GET" {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		mockAuthorizePage.Execute(w, map[string]interface{}{"RedirectURI": redirect, "State": r.FormValue("state"), "Users": m.users})
+		return
+	}
+	q := url.Values{"state": {r.FormValue("state")}}
+	if r.FormValue("deny") != "" {
+		q.Set("error", "access_denied")
+		q.Set("error_description", "The user denied access")
+		http.Redirect(w, r, redirect+"?"+q.Encode(), http.StatusFound)
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.user(r.FormValue("user")); !ok {
+		http.Error(w, "Unknown user", http.StatusBadRequest)
+		return
+	}
+	code, err := randomHex(16)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	m.codes[code] = r.FormValue("user")
+	q.Set("code", code)
+	http.Redirect(w, r, redirect+"?"+q.Encode(), http.StatusFound)
+}
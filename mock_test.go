@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+const mockAda = "7d1b3c1e-0c2a-4f36-9d5e-2f3a8b6c4e01"
+
+func TestMockModeLogin(t *testing.T) {
+	newTestApp(t) // for the store, audit log and config it restores
+	savedBase, savedServer := apiTransport.base, mockServer
+	t.Cleanup(func() { apiTransport.base, mockServer = savedBase, savedServer })
+	enableMock(newMockHeroku())
+	app := httptest.NewTLSServer(routes())
+	t.Cleanup(app.Close)
+	client := app.Client()
+	client.Jar, _ = cookiejar.New(nil)
+
+	resp, err := client.Get(app.URL + "/auth/heroku")
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.Request.URL.Path != "/mock/authorize" || !strings.Contains(string(page), "Ada Lovelace") {
+		t.Fatalf("sign in ended at %s: %s", resp.Request.URL, page)
+	}
+
+	resp, err = client.PostForm(app.URL+"/mock/authorize", url.Values{
+		"user":         {mockAda},
+		"state":        {resp.Request.URL.Query().Get("state")},
+		"redirect_uri": {resp.Request.URL.Query().Get("redirect_uri")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.Request.URL.Path != "/user" || !strings.Contains(string(body), "Hello ada@example.com") || !strings.Contains(string(body), "analytical-engines") {
+		t.Fatalf("login ended at %s with %d: %s", resp.Request.URL, resp.StatusCode, body)
+	}
+
+	resp, err = client.PostForm(app.URL+"/mock/authorize", url.Values{"user": {mockAda}, "redirect_uri": {"https://evil.example/cb"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("foreign redirect_uri = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestMockAPI(t *testing.T) {
+	m := newMockHeroku()
+	m.codes["code-1"] = mockAda
+	savedURL := herokuAPIURL
+	t.Cleanup(func() { herokuAPIURL = savedURL })
+	herokuAPIURL = "http://" + mockHost
+
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Transport: &mockTransport{handler: m.routes()}})
+	config := &oauth2.Config{Endpoint: oauth2.Endpoint{TokenURL: "http://" + mockHost + "/oauth/token"}}
+	token, err := config.Exchange(ctx, "code-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := config.Exchange(ctx, "code-1"); err == nil {
+		t.Error("code was accepted twice")
+	}
+	client := config.Client(ctx, token)
+
+	var apps []struct{ Name string }
+	if err := herokuGet(client, "/apps", &apps); err != nil || len(apps) != 2 {
+		t.Fatalf("apps = %v, %v", apps, err)
+	}
+	if err := herokuGet(client, "/apps/cobol-compiler/releases", nil); err == nil {
+		t.Error("another user's app was visible")
+	}
+	var releases []struct{ Version int }
+	if err := herokuGet(client, "/apps/difference-engine/releases", &releases); err != nil || len(releases) != 3 {
+		t.Errorf("releases = %v, %v", releases, err)
+	}
+	if err := herokuDo(client, "PATCH", "/apps/difference-engine/formation/web", map[string]int{"quantity": 5}, nil); err != nil {
+		t.Fatal(err)
+	}
+	var formation []mockFormation
+	if err := herokuGet(client, "/apps/difference-engine/formation", &formation); err != nil || formation[0].Quantity != 5 {
+		t.Errorf("formation after scaling = %+v, %v", formation, err)
+	}
+	if err := herokuDo(client, "DELETE", "/apps/difference-engine/dynos/web", nil, nil); err != nil {
+		t.Errorf("restart: %v", err)
+	}
+}
+
+func TestMockModeRefusedOnDyno(t *testing.T) {
+	saved := mockMode
+	t.Cleanup(func() { mockMode = saved })
+	mockMode = true
+	t.Setenv("DYNO", "web.1")
+	if err := checkDevMode(); err == nil {
+		t.Error("MOCK_MODE allowed on a dyno")
+	}
+}
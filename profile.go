@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// herokuAccount is the Platform API account resource.
+// See https://devcenter.heroku.com/articles/platform-api-reference#account
+type herokuAccount struct {
+	ID                  string     `json:"id"`
+	Email               string     `json:"email"`
+	Name                string     `json:"name"`
+	Verified            bool       `json:"verified"`
+	TwoFactor           bool       `json:"two_factor_authentication"`
+	AllowTracking       bool       `json:"allow_tracking"`
+	Beta                bool       `json:"beta"`
+	CreatedAt           time.Time  `json:"created_at"`
+	LastLogin           *time.Time `json:"last_login"`
+	DefaultOrganization *struct {
+		Name string `json:"name"`
+	} `json:"default_organization"`
+}
+
+// canWrite reports whether a's grant allows changing the account, which
+// takes the write scope or one that implies it.
+func canWrite(a *account) bool {
+	for _, s := range a.Scopes {
+		if s == "write" || s == "write-protected" || s == "global" {
+			return true
+		}
+	}
+	return false
+}
+
+// gravatarURL is the avatar for email. See https://docs.gravatar.com/api/avatars/hash/
+func gravatarURL(email string) string {
+	sum := md5.Sum([]byte(strings.ToLower(strings.TrimSpace(email))))
+	return "https://www.gravatar.com/avatar/" + hex.EncodeToString(sum[:]) + "?s=80&d=identicon"
+}
+
+func writeProfile(w io.Writer, s *sessions.Session, a *account, acct *herokuAccount) {
+	yesNo := func(b bool) string {
+		if b {
+			return "yes"
+		}
+		return "no"
+	}
+	lastLogin, org := "never", "none"
+	if acct.LastLogin != nil {
+		lastLogin = acct.LastLogin.Format(time.RFC1123)
+	}
+	if acct.DefaultOrganization != nil {
+		org = acct.DefaultOrganization.Name
+	}
+	fmt.Fprint(w, `<table>`)
+	for _, row := range [][2]string{
+		{"Name", acct.Name},
+		{"User ID", acct.ID},
+		{"Verified", yesNo(acct.Verified)},
+		{"Two-factor authentication", yesNo(acct.TwoFactor)},
+		{"Created", acct.CreatedAt.Format(time.RFC1123)},
+		{"Last login", lastLogin},
+		{"Default organization", org},
+		{"Allow tracking", yesNo(acct.AllowTracking)},
+		{"Beta features", yesNo(acct.Beta)},
+	} {
+		fmt.Fprintf(w, `<tr><th>%s</th><td>%s</td></tr>`, row[0], html.EscapeString(row[1]))
+	}
+	fmt.Fprint(w, `</table>`)
+	if !canWrite(a) {
+		fmt.Fprint(w, `<p>Sign in with the <code>write</code> scope to change these settings.</p>`)
+		return
+	}
+	checked := func(b bool) string {
+		if b {
+			return " checked"
+		}
+		return ""
+	}
+	fmt.Fprintf(w, `<h2>Settings</h2><form method="post" action="/user">`+csrfInput(s)+
+		`<p>Name <input name="name" value="%s"></p>`+
+		`<p><label><input type="checkbox" name="allow_tracking"%s> Allow tracking</label></p>`+
+		`<p><label><input type="checkbox" name="beta"%s> Beta features</label></p>`+
+		`<p><button>Save</button></p></form>`,
+		html.EscapeString(acct.Name), checked(acct.AllowTracking), checked(acct.Beta))
+}
+
+// handleProfileUpdate saves the settings form on /user with PATCH /account.
+func handleProfileUpdate(w http.ResponseWriter, r *http.Request, s *sessions.Session, a *account) {
+	if a.Provider != "heroku" {
+		http.Error(w, a.label()+" is not a Heroku account", http.StatusBadRequest)
+		return
+	}
+	if !canWrite(a) {
+		http.Error(w, "Changing account settings needs the write scope", http.StatusForbidden)
+		return
+	}
+	ctx, cancel := outboundContext(r.Context(), apiTimeout)
+	defer cancel()
+	client, err := a.client(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	r.ParseForm()
+	err = herokuDo(client, "PATCH", "/account", map[string]interface{}{
+		"name":           r.FormValue("name"),
+		"allow_tracking": r.FormValue("allow_tracking") != "",
+		"beta":           r.FormValue("beta") != "",
+	}, nil)
+	if err != nil {
+		audits.record(r, a, auditEvent{Action: "account.update", Target: a.Identity.ID, Outcome: auditFailure, Detail: err.Error()})
+		apiError(w, err)
+		return
+	}
+	audits.record(r, a, auditEvent{Action: "account.update", Target: a.Identity.ID, Outcome: auditSuccess})
+	http.Redirect(w, r, "/user", http.StatusFound)
+}
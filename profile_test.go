@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestProfilePage(t *testing.T) {
+	app := newTestApp(t)
+	app.login(t)
+	_, body := app.get(t, "/user")
+	for _, want := range []string{"Example User", app.heroku.User.ID, gravatarURL("User@Example.com "), "write</code> scope"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("profile page is missing %q", want)
+		}
+	}
+	if resp := app.postForm(t, "/user", url.Values{"name": {"Changed"}}); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("update without the write scope = %d, want %d", resp.StatusCode, http.StatusForbidden)
+	}
+}
+
+func TestProfileUpdate(t *testing.T) {
+	app := newTestApp(t)
+	oauthConfig.Scopes = []string{"identity", "read", "write"}
+	app.login(t)
+	_, body := app.get(t, "/user")
+	if !strings.Contains(body, `action="/user"`) {
+		t.Fatalf("no settings form with the write scope: %s", body)
+	}
+	resp := app.postForm(t, "/user", url.Values{"name": {"New <Name>"}, "beta": {"on"}})
+	if resp.StatusCode != http.StatusOK || resp.Request.URL.Path != "/user" {
+		t.Fatalf("update ended at %s with %d", resp.Request.URL, resp.StatusCode)
+	}
+	if u := app.heroku.User; u.Name != "New <Name>" || !u.Beta || u.AllowTracking {
+		t.Errorf("account after update = %+v", u)
+	}
+	if _, body := app.get(t, "/user"); !strings.Contains(body, "New &lt;Name&gt;") {
+		t.Errorf("profile page does not show the new name")
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+const defaultProvider = "heroku"
+
+// identity is the normalized view of a signed in user, whichever provider
+// they authenticated with.
+type identity struct {
+	ID    string
+	Email string
+	Name  string
+	// Verified reports whether the provider confirmed the user owns Email.
+	Verified bool
+}
+
+// provider bundles everything needed to run the OAuth web flow against one
+// identity provider and turn the resulting token into an identity.
+type provider struct {
+	Name     string
+	Title    string
+	Config   *oauth2.Config
+	Identify func(ctx context.Context, client *http.Client) (identity, error)
+}
+
+var providers = map[string]*provider{}
+
+func registerProvider(p *provider) {
+	providers[p.Name] = p
+}
+
+func lookupProvider(name string) (*provider, bool) {
+	p, ok := providers[name]
+	return p, ok
+}
+
+// sortedProviders returns the registered providers with the default first
+// and the rest in name order.
+func sortedProviders() []*provider {
+	var ps []*provider
+	for _, p := range providers {
+		ps = append(ps, p)
+	}
+	sort.Slice(ps, func(i, j int) bool {
+		if ps[i].Name == defaultProvider || ps[j].Name == defaultProvider {
+			return ps[i].Name == defaultProvider
+		}
+		return ps[i].Name < ps[j].Name
+	})
+	return ps
+}
+
+func callbackURL(name string) string {
+	return appURL + "/auth/" + name + "/callback"
+}
+
+func init() {
+	registerProvider(&provider{
+		Name:     "heroku",
+		Title:    "Heroku",
+		Config:   oauthConfig,
+		Identify: identifyHeroku,
+	})
+
+	if id := getenv("GITHUB_OAUTH_ID"); id != "" {
+		registerProvider(&provider{
+			Name:  "github",
+			Title: "GitHub",
+			Config: &oauth2.Config{
+				ClientID:     id,
+				ClientSecret: getenv("GITHUB_OAUTH_SECRET"),
+				Endpoint: oauth2.Endpoint{
+					AuthURL:  "https://github.com/login/oauth/authorize",
+					TokenURL: "https://github.com/login/oauth/access_token",
+				},
+				Scopes:      []string{"read:user", "user:email"}, // See https://docs.github.com/en/apps/oauth-apps/building-oauth-apps/scopes-for-oauth-apps
+				RedirectURL: callbackURL("github"),
+			},
+			Identify: identifyGitHub,
+		})
+	}
+
+	if id := getenv("OIDC_CLIENT_ID"); id != "" {
+		name := getenvDefault("OIDC_NAME", "oidc")
+		userInfoURL := getenv("OIDC_USERINFO_URL")
+		registerProvider(&provider{
+			Name:  name,
+			Title: name,
+			Config: &oauth2.Config{
+				ClientID:     id,
+				ClientSecret: getenv("OIDC_CLIENT_SECRET"),
+				Endpoint: oauth2.Endpoint{
+					AuthURL:  getenv("OIDC_AUTH_URL"),
+					TokenURL: getenv("OIDC_TOKEN_URL"),
+				},
+				Scopes:      []string{"openid", "email", "profile"},
+				RedirectURL: callbackURL(name),
+			},
+			Identify: func(ctx context.Context, client *http.Client) (identity, error) {
+				return identifyOIDC(client, userInfoURL)
+			},
+		})
+	}
+}
+
+func getJSON(client *http.Client, url string, v interface{}) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func identifyHeroku(ctx context.Context, client *http.Client) (identity, error) {
+	var account struct { // See https://devcenter.heroku.com/articles/platform-api-reference#account
+		ID       string `json:"id"`
+		Email    string `json:"email"`
+		Name     string `json:"name"`
+		Verified bool   `json:"verified"`
+	}
+	if err := herokuGet(client, "/account", &account); err != nil {
+		return identity{}, err
+	}
+	return identity{ID: account.ID, Email: account.Email, Name: account.Name, Verified: account.Verified}, nil
+}
+
+func identifyGitHub(ctx context.Context, client *http.Client) (identity, error) {
+	var user struct { // See https://docs.github.com/en/rest/users/users#get-the-authenticated-user
+		ID    int64  `json:"id"`
+		Login string `json:"login"`
+		Name  string `json:"name"`
+		Email string `json:"email"`
+	}
+	if err := getJSON(client, "https://api.github.com/user", &user); err != nil {
+		return identity{}, err
+	}
+	id := identity{ID: strconv.FormatInt(user.ID, 10), Email: user.Email, Name: user.Name}
+	if id.Name == "" {
+		id.Name = user.Login
+	}
+	// The profile doesn't say whether its email is verified; the emails list does.
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	if err := getJSON(client, "https://api.github.com/user/emails", &emails); err != nil {
+		return identity{}, err
+	}
+	for _, e := range emails {
+		if id.Email == "" && e.Primary {
+			id.Email = e.Email
+		}
+	}
+	for _, e := range emails {
+		if strings.EqualFold(e.Email, id.Email) {
+			id.Verified = e.Verified
+		}
+	}
+	return id, nil
+}
+
+func identifyOIDC(client *http.Client, userInfoURL string) (identity, error) {
+	var claims struct { // See https://openid.net/specs/openid-connect-core-1_0.html#UserInfo
+		Subject       string `json:"sub"`
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+		Name          string `json:"name"`
+	}
+	if err := getJSON(client, userInfoURL, &claims); err != nil {
+		return identity{}, err
+	}
+	return identity{ID: claims.Subject, Email: claims.Email, Name: claims.Name, Verified: claims.EmailVerified}, nil
+}
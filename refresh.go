@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+var errNoRefreshToken = errors.New("oauth2: token expired and refresh token is not set")
+
+var (
+	tokenRefreshes       = expvar.NewInt("token_refreshes")
+	tokenRefreshesShared = expvar.NewInt("token_refreshes_shared")
+)
+
+// refreshGroup spends each refresh token once. Callers refreshing with the
+// same refresh token while a refresh is in flight wait for it and share its
+// result, and a successful result is kept for a while so requests still
+// carrying the old token in their cookie reuse it rather than presenting a
+// refresh token the provider may already have rotated out.
+type refreshGroup struct {
+	keep time.Duration
+	now  func() time.Time
+
+	mu    sync.Mutex
+	calls map[string]*refreshCall
+}
+
+type refreshCall struct {
+	done  chan struct{}
+	token *oauth2.Token
+	err   error
+	at    time.Time
+}
+
+// refreshes coordinates refreshes for browser sessions and stored users,
+// which can hold the same grant.
+var refreshes = newRefreshGroup(time.Minute)
+
+func newRefreshGroup(keep time.Duration) *refreshGroup {
+	return &refreshGroup{keep: keep, now: time.Now, calls: map[string]*refreshCall{}}
+}
+
+// do returns the token refreshed for key, calling fetch only if no other
+// caller is already doing so or recently did.
+func (g *refreshGroup) do(key string, fetch func() (*oauth2.Token, error)) (*oauth2.Token, error) {
+	g.mu.Lock()
+	now := g.now()
+	for k, c := range g.calls {
+		if !c.at.IsZero() && now.Sub(c.at) > g.keep {
+			delete(g.calls, k)
+		}
+	}
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		<-c.done
+		tokenRefreshesShared.Add(1)
+		return c.token, c.err
+	}
+	c := &refreshCall{done: make(chan struct{})}
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	tokenRefreshes.Add(1)
+	c.token, c.err = fetch()
+	g.mu.Lock()
+	c.at = g.now()
+	if c.err != nil {
+		// Waiters share the failure, later callers try again.
+		delete(g.calls, key)
+	}
+	g.mu.Unlock()
+	close(c.done)
+	return c.token, c.err
+}
+
+// sharedRefresh exchanges refreshToken for a new token from config,
+// sharing the result with concurrent refreshes of the same grant.
+func sharedRefresh(ctx context.Context, config *oauth2.Config, refreshToken string) (*oauth2.Token, error) {
+	if refreshToken == "" {
+		return nil, errNoRefreshToken
+	}
+	return refreshes.do(config.Endpoint.TokenURL+" "+refreshToken, func() (*oauth2.Token, error) {
+		return config.TokenSource(ctx, &oauth2.Token{RefreshToken: refreshToken}).Token()
+	})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestRefreshGroup(t *testing.T) {
+	now := time.Now()
+	var mu sync.Mutex
+	g := newRefreshGroup(time.Minute)
+	g.now = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	var fetches int32
+	fetch := func() (*oauth2.Token, error) {
+		n := atomic.AddInt32(&fetches, 1)
+		time.Sleep(50 * time.Millisecond)
+		return &oauth2.Token{AccessToken: fmt.Sprint("access-", n)}, nil
+	}
+
+	var wg sync.WaitGroup
+	tokens := make([]*oauth2.Token, 20)
+	for i := range tokens {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tokens[i], _ = g.do("refresh-1", fetch)
+		}(i)
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Fatalf("%d concurrent refreshes, want 1", n)
+	}
+	for i, tok := range tokens {
+		if tok == nil || tok.AccessToken != "access-1" {
+			t.Fatalf("caller %d got %v", i, tok)
+		}
+	}
+
+	// A late request still carrying the old refresh token reuses the result.
+	if tok, _ := g.do("refresh-1", fetch); tok.AccessToken != "access-1" || atomic.LoadInt32(&fetches) != 1 {
+		t.Errorf("late caller got %s after %d fetches", tok.AccessToken, fetches)
+	}
+	mu.Lock()
+	now = now.Add(2 * time.Minute)
+	mu.Unlock()
+	if tok, _ := g.do("refresh-1", fetch); tok.AccessToken != "access-2" {
+		t.Errorf("result kept past its lifetime: got %s", tok.AccessToken)
+	}
+
+	// Failures are shared with waiters but not remembered.
+	failed := errors.New("invalid_grant")
+	if _, err := g.do("refresh-2", func() (*oauth2.Token, error) { return nil, failed }); err != failed {
+		t.Fatalf("err = %v", err)
+	}
+	if tok, err := g.do("refresh-2", fetch); err != nil || tok == nil {
+		t.Errorf("retry after failure = %v, %v", tok, err)
+	}
+}
+
+func TestConcurrentRefreshWithRotation(t *testing.T) {
+	app := newTestApp(t)
+	app.heroku.setRotateRefresh(true)
+	app.heroku.setExpiresIn(11)
+	app.login(t)
+	time.Sleep(1100 * time.Millisecond)
+	app.heroku.setExpiresIn(3600)
+	app.heroku.setDelay("refresh", 100*time.Millisecond)
+
+	var wg sync.WaitGroup
+	statuses := make([]int, 10)
+	for i := range statuses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := app.client.Get(app.URL + "/user")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+			statuses[i] = resp.StatusCode
+		}(i)
+	}
+	wg.Wait()
+	for i, status := range statuses {
+		if status != http.StatusOK {
+			t.Errorf("request %d = %d", i, status)
+		}
+	}
+	if n := app.heroku.refreshCount(); n != 1 {
+		t.Errorf("refreshed %d times, want 1", n)
+	}
+}
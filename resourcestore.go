@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// Add-on resource states.
+const (
+	resourceProvisioning = "provisioning"
+	resourceProvisioned  = "provisioned"
+	resourceFailed       = "failed"
+)
+
+// resource is an add-on instance provisioned by Heroku.
+type resource struct {
+	ID        string        `json:"id"`
+	Plan      string        `json:"plan"`
+	Region    string        `json:"region,omitempty"`
+	State     string        `json:"state"`
+	Error     string        `json:"error,omitempty"`
+	Token     *oauth2.Token `json:"-"`
+	CreatedAt time.Time     `json:"created_at"`
+	UpdatedAt time.Time     `json:"updated_at"`
+
+	SealedToken string `json:"token,omitempty"` // Token encrypted with the store's key
+}
+
+// resourceStore keeps add-on resources in a JSON file, rewriting it on every
+// change. It is meant for a single process; use a database when running
+// more than one dyno. Tokens are encrypted with AES-GCM like the user store's,
+// under a key of their own.
+type resourceStore struct {
+	path   string
+	sealer *sealer // nil without RESOURCE_STORE_KEY; tokens can't be stored
+
+	mu        sync.Mutex
+	loaded    bool
+	resources map[string]*resource
+}
+
+var resources = openResourceStore(getenvDefault("RESOURCE_STORE", "resources.json"), getenv("RESOURCE_STORE_KEY"))
+
+var errNoResourceKey = errors.New("RESOURCE_STORE_KEY is not set, so add-on tokens cannot be stored")
+
+// openResourceStore returns the store at path, sealing tokens with hexKey,
+// a hex encoded 16, 24 or 32 byte key, if it is set.
+func openResourceStore(path, hexKey string) *resourceStore {
+	s, err := newResourceStore(path, hexKey)
+	if err != nil {
+		log.Fatalf("RESOURCE_STORE_KEY: %v", err)
+	}
+	return s
+}
+
+func newResourceStore(path, hexKey string) (*resourceStore, error) {
+	s := &resourceStore{path: path}
+	if hexKey != "" {
+		sealer, err := newSealer(hexKey)
+		if err != nil {
+			return nil, err
+		}
+		s.sealer = &sealer
+	}
+	return s, nil
+}
+
+func (s *resourceStore) load() error {
+	if s.loaded {
+		return nil
+	}
+	s.resources = map[string]*resource{}
+	if err := readJSONFile(s.path, &s.resources); err != nil {
+		return err
+	}
+	for _, r := range s.resources {
+		if r.SealedToken == "" {
+			continue
+		}
+		if s.sealer == nil {
+			return errNoResourceKey
+		}
+		b, err := s.sealer.decrypt(r.ID, r.SealedToken)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal([]byte(b), &r.Token); err != nil {
+			return err
+		}
+	}
+	s.loaded = true
+	return nil
+}
+
+func (s *resourceStore) save() error {
+	for _, r := range s.resources {
+		r.SealedToken = ""
+		if r.Token == nil {
+			continue
+		}
+		if s.sealer == nil {
+			return errNoResourceKey
+		}
+		b, err := json.Marshal(r.Token)
+		if err != nil {
+			return err
+		}
+		if r.SealedToken, err = s.sealer.encrypt(r.ID, string(b)); err != nil {
+			return err
+		}
+	}
+	return writeJSONFile(s.path, s.resources)
+}
+
+// get returns a copy of the resource with id.
+func (s *resourceStore) get(id string) (resource, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return resource{}, false, err
+	}
+	r, ok := s.resources[id]
+	if !ok {
+		return resource{}, false, nil
+	}
+	return *r, true, nil
+}
+
+// put stores r, replacing any resource with the same ID.
+func (s *resourceStore) put(r resource) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return err
+	}
+	r.UpdatedAt = time.Now()
+	s.resources[r.ID] = &r
+	return s.save()
+}
+
+// update applies fn to the stored resource with id, reporting whether it
+// exists.
+func (s *resourceStore) update(id string, fn func(*resource)) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return false, err
+	}
+	r, ok := s.resources[id]
+	if !ok {
+		return false, nil
+	}
+	fn(r)
+	r.UpdatedAt = time.Now()
+	return true, s.save()
+}
+
+func (s *resourceStore) delete(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return false, err
+	}
+	if _, ok := s.resources[id]; !ok {
+		return false, nil
+	}
+	delete(s.resources, id)
+	return true, s.save()
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var errCircuitOpen = errors.New("circuit open")
+
+var (
+	outboundRetries = expvar.NewMap("outbound_retries")
+	circuitOpens    = expvar.NewMap("circuit_opens")
+)
+
+// retryTransport retries idempotent requests that fail to connect or get a
+// 5xx or 429 response, backing off exponentially with jitter and honouring
+// Retry-After. It also keeps a circuit breaker per host so that once a host
+// keeps failing, requests to it fail straight away with errCircuitOpen
+// until a probe after the cooldown succeeds.
+type retryTransport struct {
+	base       http.RoundTripper
+	maxRetries int
+	baseDelay  time.Duration
+	maxDelay   time.Duration
+	threshold  int           // consecutive failures that open a circuit
+	cooldown   time.Duration // how long a circuit stays open before a probe
+	now        func() time.Time
+
+	mu       sync.Mutex
+	breakers map[string]*breaker
+}
+
+type breaker struct {
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+func newRetryTransport(base http.RoundTripper) *retryTransport {
+	t := &retryTransport{
+		base:       base,
+		maxRetries: 3,
+		baseDelay:  200 * time.Millisecond,
+		maxDelay:   5 * time.Second,
+		threshold:  5,
+		cooldown:   30 * time.Second,
+		now:        time.Now,
+		breakers:   map[string]*breaker{},
+	}
+	return t
+}
+
+// apiTransport sits beneath every outbound client, under the oauth2
+// transport that adds tokens.
+var apiTransport = newRetryTransport(httpTransport)
+
+func init() {
+	expvar.Publish("circuit_state", expvar.Func(apiTransport.states))
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	for attempt := 0; ; attempt++ {
+		if !t.allow(host) {
+			return nil, errCircuitOpen
+		}
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+		resp, err := t.base.RoundTrip(req)
+		failed := err != nil || resp.StatusCode >= 500
+		if errors.Is(err, context.Canceled) || req.Context().Err() != nil {
+			// The caller gave up, say a closed tab; that says nothing about
+			// the host.
+			t.abandon(host)
+		} else {
+			t.record(host, failed)
+		}
+		retry := failed || resp.StatusCode == http.StatusTooManyRequests
+		if !retry || attempt >= t.maxRetries || !retryable(req) || req.Context().Err() != nil {
+			return resp, err
+		}
+
+		delay := t.backoff(attempt)
+		if resp != nil {
+			if d, ok := parseRetryAfter(resp.Header.Get("Retry-After"), t.now()); ok {
+				delay = d
+			}
+		}
+		if deadline, ok := req.Context().Deadline(); ok && t.now().Add(delay).After(deadline) {
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		outboundRetries.Add(host, 1)
+		log.Printf("retrying %s %s in %v (attempt %d): %v", req.Method, req.URL.Redacted(), delay, attempt+1, failure(resp, err))
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+func failure(resp *http.Response, err error) interface{} {
+	if err != nil {
+		return err
+	}
+	return resp.Status
+}
+
+// retryable reports whether req may safely be sent again.
+func retryable(req *http.Request) bool {
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS", "PUT", "DELETE":
+		return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+	}
+	return false
+}
+
+func (t *retryTransport) backoff(attempt int) time.Duration {
+	d := t.baseDelay << uint(attempt)
+	if d > t.maxDelay || d <= 0 {
+		d = t.maxDelay
+	}
+	return time.Duration(rand.Int63n(int64(d)) + 1)
+}
+
+// parseRetryAfter parses a Retry-After header given in seconds or as an
+// HTTP date.
+func parseRetryAfter(v string, now time.Time) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if s, err := strconv.Atoi(v); err == nil && s >= 0 {
+		return time.Duration(s) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := t.Sub(now); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// allow reports whether a request to host may go ahead. Once an open
+// circuit's cooldown has passed a single probe request is let through.
+func (t *retryTransport) allow(host string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b := t.breakers[host]
+	if b == nil || b.openUntil.IsZero() {
+		return true
+	}
+	if t.now().Before(b.openUntil) || b.probing {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+func (t *retryTransport) record(host string, failed bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b := t.breakers[host]
+	if b == nil {
+		b = &breaker{}
+		t.breakers[host] = b
+	}
+	if !failed {
+		if !b.openUntil.IsZero() {
+			log.Printf("circuit for %s closed", host)
+		}
+		*b = breaker{}
+		return
+	}
+	b.failures++
+	if b.probing || (b.openUntil.IsZero() && b.failures >= t.threshold) {
+		b.openUntil = t.now().Add(t.cooldown)
+		b.probing = false
+		circuitOpens.Add(host, 1)
+		log.Printf("circuit for %s opened for %v after %d consecutive failures", host, t.cooldown, b.failures)
+	}
+}
+
+// abandon releases a half-open circuit's probe without counting it either
+// way, so the next request after the cooldown probes again.
+func (t *retryTransport) abandon(host string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if b := t.breakers[host]; b != nil {
+		b.probing = false
+	}
+}
+
+// states reports each host's circuit as "closed", "open" or "half-open".
+func (t *retryTransport) states() interface{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	states := map[string]string{}
+	for host, b := range t.breakers {
+		switch {
+		case b.openUntil.IsZero():
+			states[host] = "closed"
+		case t.now().Before(b.openUntil):
+			states[host] = "open"
+		default:
+			states[host] = "half-open"
+		}
+	}
+	return states
+}
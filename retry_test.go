@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyServer fails the first fails requests with status, then succeeds.
+type flakyServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests int
+}
+
+func newFlakyServer(fails, status int, retryAfter string) *flakyServer {
+	f := &flakyServer{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		f.requests++
+		n := f.requests
+		f.mu.Unlock()
+		if n <= fails {
+			if retryAfter != "" {
+				w.Header().Set("Retry-After", retryAfter)
+			}
+			w.WriteHeader(status)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	return f
+}
+
+func (f *flakyServer) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests
+}
+
+func testRetryTransport() *retryTransport {
+	t := newRetryTransport(http.DefaultTransport)
+	t.baseDelay, t.maxDelay = time.Millisecond, 5*time.Millisecond
+	return t
+}
+
+func TestRetryIdempotent(t *testing.T) {
+	srv := newFlakyServer(2, http.StatusServiceUnavailable, "")
+	defer srv.Close()
+	client := &http.Client{Transport: testRetryTransport()}
+
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || srv.count() != 3 {
+		t.Errorf("GET = %d after %d requests, want 200 after 3", resp.StatusCode, srv.count())
+	}
+}
+
+func TestNoRetryForPost(t *testing.T) {
+	srv := newFlakyServer(1, http.StatusInternalServerError, "")
+	defer srv.Close()
+	client := &http.Client{Transport: testRetryTransport()}
+
+	resp, err := client.Post(srv.URL, "text/plain", strings.NewReader("body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError || srv.count() != 1 {
+		t.Errorf("POST = %d after %d requests, want 500 after 1", resp.StatusCode, srv.count())
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		header string
+		want   time.Duration
+		ok     bool
+	}{
+		{"", 0, false},
+		{"3", 3 * time.Second, true},
+		{now.Add(time.Minute).Format(http.TimeFormat), time.Minute, true},
+		{"soon", 0, false},
+	} {
+		got, ok := parseRetryAfter(tt.header, now)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parseRetryAfter(%q) = %v, %v; want %v, %v", tt.header, got, ok, tt.want, tt.ok)
+		}
+	}
+
+	srv := newFlakyServer(1, http.StatusTooManyRequests, "1")
+	defer srv.Close()
+	client := &http.Client{Transport: testRetryTransport()}
+	start := time.Now()
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if d := time.Since(start); resp.StatusCode != http.StatusOK || d < time.Second {
+		t.Errorf("GET = %d after %v, want 200 after waiting at least 1s", resp.StatusCode, d)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	srv := newFlakyServer(1000, http.StatusBadGateway, "")
+	defer srv.Close()
+	rt := testRetryTransport()
+	rt.maxRetries, rt.threshold, rt.cooldown = 0, 3, time.Minute
+	now := time.Now()
+	rt.now = func() time.Time { return now }
+	client := &http.Client{Transport: rt}
+
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		resp.Body.Close()
+	}
+	if _, err := client.Get(srv.URL); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("GET with an open circuit = %v, want errCircuitOpen", err)
+	}
+	if srv.count() != 3 {
+		t.Errorf("server saw %d requests, want 3", srv.count())
+	}
+
+	// After the cooldown one probe goes through; it fails, so the circuit
+	// opens again.
+	now = now.Add(2 * time.Minute)
+	if resp, err := client.Get(srv.URL); err != nil {
+		t.Fatalf("probe: %v", err)
+	} else {
+		resp.Body.Close()
+	}
+	if _, err := client.Get(srv.URL); !errors.Is(err, errCircuitOpen) {
+		t.Errorf("GET after a failed probe = %v, want errCircuitOpen", err)
+	}
+
+	now = now.Add(2 * time.Minute)
+	srv.mu.Lock()
+	srv.requests = 2000 // succeed from now on
+	srv.mu.Unlock()
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatalf("GET after recovery: %v", err)
+		}
+		resp.Body.Close()
+	}
+	if state := rt.states().(map[string]string)[strings.TrimPrefix(srv.URL, "http://")]; state != "closed" {
+		t.Errorf("circuit state = %q, want closed", state)
+	}
+}
+
+func TestCircuitIgnoresCancelledRequests(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+	rt := testRetryTransport()
+	rt.threshold, rt.cooldown = 2, time.Minute
+	client := &http.Client{Transport: rt}
+
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		req, _ := http.NewRequest("GET", srv.URL, nil)
+		time.AfterFunc(10*time.Millisecond, cancel)
+		if _, err := client.Do(req.WithContext(ctx)); err == nil {
+			t.Fatal("cancelled request succeeded")
+		}
+	}
+	if state := rt.states().(map[string]string)[strings.TrimPrefix(srv.URL, "http://")]; state == "open" {
+		t.Errorf("circuit opened after requests their callers cancelled")
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// middleware wraps a route's handler.
+type middleware func(http.Handler) http.Handler
+
+// router matches requests on method and path. Patterns are made of literal
+// segments and {name} segments that match any single segment, available to
+// handlers through r.PathValue. Unknown paths get a 404 page and known paths
+// requested with the wrong method a 405 with an Allow header.
+type router struct {
+	routes []*route
+}
+
+type route struct {
+	method   string
+	pattern  string
+	segments []string
+	handler  http.Handler
+}
+
+func newRouter() *router {
+	return &router{}
+}
+
+// handle registers h for method and pattern, wrapped in mw with the first
+// middleware outermost.
+func (rt *router) handle(method, pattern string, h http.Handler, mw ...middleware) {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	rt.routes = append(rt.routes, &route{
+		method:   method,
+		pattern:  pattern,
+		segments: splitPath(pattern),
+		handler:  h,
+	})
+}
+
+func (rt *router) handleFunc(method, pattern string, h http.HandlerFunc, mw ...middleware) {
+	rt.handle(method, pattern, h, mw...)
+}
+
+func splitPath(p string) []string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+// match returns the path parameters if r matches path, and how many
+// literal segments it matched on.
+func (r *route) match(path []string) (map[string]string, int, bool) {
+	if len(path) != len(r.segments) {
+		return nil, 0, false
+	}
+	var params map[string]string
+	literals := 0
+	for i, seg := range r.segments {
+		if strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}") {
+			if path[i] == "" {
+				return nil, 0, false
+			}
+			if params == nil {
+				params = map[string]string{}
+			}
+			params[seg[1:len(seg)-1]] = path[i]
+			continue
+		}
+		if seg != path[i] {
+			return nil, 0, false
+		}
+		literals++
+	}
+	return params, literals, true
+}
+
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := splitPath(r.URL.Path)
+	var best *route
+	var bestParams map[string]string
+	bestLiterals := -1
+	allowed := map[string]bool{}
+	for _, rte := range rt.routes {
+		params, literals, ok := rte.match(path)
+		if !ok {
+			continue
+		}
+		allowed[rte.method] = true
+		if rte.method == "GET" {
+			allowed["HEAD"] = true
+		}
+		if rte.method != r.Method && !(r.Method == "HEAD" && rte.method == "GET") {
+			continue
+		}
+		if literals > bestLiterals {
+			best, bestParams, bestLiterals = rte, params, literals
+		}
+	}
+	switch {
+	case best != nil:
+		for k, v := range bestParams {
+			r.SetPathValue(k, v)
+		}
+		best.handler.ServeHTTP(w, r)
+	case len(allowed) > 0:
+		var methods []string
+		for m := range allowed {
+			methods = append(methods, m)
+		}
+		sort.Strings(methods)
+		w.Header().Set("Allow", strings.Join(methods, ", "))
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	default:
+		handleNotFound(w, r)
+	}
+}
+
+func handleNotFound(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusNotFound)
+	fmt.Fprint(w, `<html><body><h1>Page not found</h1><p><a href="/">Back to the start</a></p></body></html>`)
+}
+
+// table lists the registered routes, one "METHOD /pattern" per line.
+func (rt *router) table() []string {
+	var lines []string
+	for _, r := range rt.routes {
+		lines = append(lines, fmt.Sprintf("%-6s %s", r.method, r.pattern))
+	}
+	return lines
+}
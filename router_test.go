@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRouter(t *testing.T) {
+	rt := newRouter()
+	echo := func(name string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%s app=%s id=%s", name, r.PathValue("app"), r.PathValue("id"))
+		}
+	}
+	rt.handleFunc("GET", "/apps/{app}/webhooks", echo("list"))
+	rt.handleFunc("POST", "/apps/{app}/webhooks", echo("create"))
+	rt.handleFunc("POST", "/apps/{app}/webhooks/{id}/delete", echo("delete"))
+	rt.handleFunc("GET", "/apps/new/webhooks", echo("static"))
+
+	tests := []struct {
+		method, path string
+		status       int
+		body         string
+	}{
+		{"GET", "/apps/demo/webhooks", 200, "list app=demo id="},
+		{"GET", "/apps/demo/webhooks/", 200, "list app=demo id="},
+		{"HEAD", "/apps/demo/webhooks", 200, "list app=demo id="},
+		{"POST", "/apps/demo/webhooks", 200, "create app=demo id="},
+		{"POST", "/apps/demo/webhooks/w1/delete", 200, "delete app=demo id=w1"},
+		{"GET", "/apps/new/webhooks", 200, "static app= id="},
+		{"DELETE", "/apps/demo/webhooks", 405, "Method not allowed\n"},
+		{"GET", "/apps/demo/webhooks/w1/delete", 405, "Method not allowed\n"},
+		{"GET", "/apps//webhooks", 404, ""},
+		{"GET", "/apps/demo", 404, ""},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		rt.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.path, nil))
+		if rec.Code != tt.status {
+			t.Errorf("%s %s = %d, want %d", tt.method, tt.path, rec.Code, tt.status)
+			continue
+		}
+		if tt.status != 404 && rec.Body.String() != tt.body {
+			t.Errorf("%s %s body = %q, want %q", tt.method, tt.path, rec.Body.String(), tt.body)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	rt.ServeHTTP(rec, httptest.NewRequest("DELETE", "/apps/demo/webhooks", nil))
+	if allow := rec.Header().Get("Allow"); allow != "GET, HEAD, POST" {
+		t.Errorf("Allow = %q", allow)
+	}
+	rec = httptest.NewRecorder()
+	rt.ServeHTTP(rec, httptest.NewRequest("GET", "/nope", nil))
+	if !strings.Contains(rec.Body.String(), "Page not found") {
+		t.Errorf("404 body = %q", rec.Body.String())
+	}
+}
+
+func TestRouterMiddleware(t *testing.T) {
+	var order []string
+	mw := func(name string) middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+	rt := newRouter()
+	rt.handleFunc("GET", "/", func(w http.ResponseWriter, r *http.Request) { order = append(order, "handler") }, mw("outer"), mw("inner"))
+	rt.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if got := strings.Join(order, ","); got != "outer,inner,handler" {
+		t.Errorf("order = %s", got)
+	}
+	if table := rt.table(); len(table) != 1 || table[0] != "GET    /" {
+		t.Errorf("table = %q", table)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+)
+
+// sealer encrypts tokens kept at rest with AES-GCM. The ID of whatever owns
+// a token is authenticated along with it so a token cannot be moved to
+// another entry.
+type sealer struct {
+	aead cipher.AEAD
+}
+
+// newSealer returns a sealer for a hex encoded 16, 24 or 32 byte key.
+func newSealer(hexKey string) (sealer, error) {
+	key, err := hex.DecodeString(hexKey)
+	if err != nil {
+		return sealer{}, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return sealer{}, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return sealer{}, err
+	}
+	return sealer{aead: aead}, nil
+}
+
+func (s sealer) encrypt(id, token string) (string, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(s.aead.Seal(nonce, nonce, []byte(token), []byte(id))), nil
+}
+
+func (s sealer) decrypt(id, sealed string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return "", err
+	}
+	if len(b) < s.aead.NonceSize() {
+		return "", errors.New("encrypted token too short")
+	}
+	plain, err := s.aead.Open(nil, b[:s.aead.NonceSize()], b[s.aead.NonceSize():], []byte(id))
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// sessionInfo describes the current login without exposing any tokens.
+type sessionInfo struct {
+	Provider        string     `json:"provider"`
+	UserID          string     `json:"user_id"`
+	Email           string     `json:"email"`
+	Scopes          []string   `json:"scopes"`
+	TokenType       string     `json:"token_type"`
+	TokenExpiry     *time.Time `json:"token_expiry,omitempty"`
+	TokenExpiresIn  int64      `json:"token_expires_in,omitempty"`
+	HasRefreshToken bool       `json:"has_refresh_token"`
+	LinkedAt        time.Time  `json:"linked_at"`
+	LastRefresh     *time.Time `json:"last_refresh,omitempty"`
+	SessionCreated  *time.Time `json:"session_created,omitempty"`
+	SessionExpires  *time.Time `json:"session_expires,omitempty"`
+	IdleExpires     *time.Time `json:"idle_expires,omitempty"`
+	LinkedAccounts  int        `json:"linked_accounts"`
+	CSRFToken       string     `json:"csrf_token"` // for POST /token and other non-form requests
+}
+
+func newSessionInfo(s *sessions.Session, a *account, now time.Time) sessionInfo {
+	info := sessionInfo{
+		Provider:        a.Provider,
+		UserID:          a.Identity.ID,
+		Email:           a.Identity.Email,
+		Scopes:          a.Scopes,
+		TokenType:       a.Token.Type(),
+		HasRefreshToken: a.Token.RefreshToken != "",
+		LinkedAt:        a.LinkedAt,
+		LinkedAccounts:  len(sessionAccounts(s)),
+	}
+	info.CSRFToken, _ = s.Values["csrf"].(string)
+	if !a.Token.Expiry.IsZero() {
+		expiry := a.Token.Expiry
+		info.TokenExpiry = &expiry
+		info.TokenExpiresIn = int64(expiry.Sub(now) / time.Second)
+	}
+	if !a.LastRefresh.IsZero() {
+		last := a.LastRefresh
+		info.LastRefresh = &last
+	}
+	if created, ok := s.Values["created"].(time.Time); ok {
+		info.SessionCreated = &created
+	}
+	if idle, absolute, ok := sessionDeadlines(s); ok {
+		info.SessionExpires = &absolute
+		info.IdleExpires = &idle
+	}
+	return info
+}
+
+func wantsJSON(r *http.Request) bool {
+	return r.FormValue("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+func handleSession(w http.ResponseWriter, r *http.Request, s *sessions.Session, a *account) {
+	now := time.Now()
+	info := newSessionInfo(s, a, now)
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(info)
+		return
+	}
+
+	row := func(name, value string) {
+		fmt.Fprintf(w, `<tr><th align="left">%s</th><td>%s</td></tr>`, name, html.EscapeString(value))
+	}
+	when := func(t *time.Time) string {
+		if t == nil {
+			return "never"
+		}
+		return t.Format(time.RFC1123) + " (" + relative(t.Sub(now)) + ")"
+	}
+	fmt.Fprint(w, `<html><body>`)
+	writeAccountBar(w, s, a)
+	fmt.Fprint(w, `<h1>Session</h1><table>`)
+	row("Provider", info.Provider)
+	row("User ID", info.UserID)
+	row("Email", info.Email)
+	row("Scopes", strings.Join(info.Scopes, " "))
+	row("Token type", info.TokenType)
+	row("Access token expires", when(info.TokenExpiry))
+	row("Refresh token", fmt.Sprint(info.HasRefreshToken))
+	row("Linked", when(&info.LinkedAt))
+	row("Last refreshed", when(info.LastRefresh))
+	row("Session created", when(info.SessionCreated))
+	row("Session expires", when(info.SessionExpires))
+	row("Idle timeout", when(info.IdleExpires))
+	row("Linked accounts", fmt.Sprint(info.LinkedAccounts))
+	fmt.Fprint(w, `</table><p><a href="/session?format=json">JSON</a></p></body></html>`)
+}
+
+// relative formats d as "in 5m0s" or "5m0s ago".
+func relative(d time.Duration) string {
+	d = d.Round(time.Second)
+	if d < 0 {
+		return (-d).String() + " ago"
+	}
+	return "in " + d.String()
+}
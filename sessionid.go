@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// sessionCarryOver are the only values kept when a session is regenerated.
+// Anything else a visitor arrived with is dropped.
+var sessionCarryOver = []string{"accounts", "current-account", "sso", "created", "expires", "seen", "remember", "return-to"}
+
+// revokedSessions holds the IDs of sessions replaced by regenerateSession or
+// ended by logout. The cookie store keeps no server-side state, so this is
+// what stops an old cookie from being replayed. It lives in memory and is
+// per process.
+var revokedSessions = &revocations{ids: map[string]time.Time{}}
+
+type revocations struct {
+	mu  sync.Mutex
+	ids map[string]time.Time
+}
+
+// revoke rejects id until it would have expired anyway.
+func (v *revocations) revoke(id string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	now := time.Now()
+	for old, until := range v.ids {
+		if now.After(until) {
+			delete(v.ids, old)
+		}
+	}
+	v.ids[id] = now.Add(time.Duration(store.Options.MaxAge) * time.Second)
+}
+
+func (v *revocations) revoked(id string) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	until, ok := v.ids[id]
+	return ok && time.Now().Before(until)
+}
+
+// loadSession returns the request's session, or a new empty one if it was
+// revoked.
+func loadSession(r *http.Request) (*sessions.Session, error) {
+	s, err := store.Get(r, sessionName)
+	if err != nil {
+		return s, err
+	}
+	if id, ok := s.Values["sid"].(string); ok && revokedSessions.revoked(id) {
+		s.Values = map[interface{}]interface{}{}
+		s.IsNew = true
+	}
+	return s, nil
+}
+
+// regenerateSession replaces s with a freshly issued session, keeping only
+// sessionCarryOver, and revokes the old one. Call it at every privilege
+// change, before adding the new privileges, and save s afterwards.
+func regenerateSession(s *sessions.Session) error {
+	id, err := randomHex(16)
+	if err != nil {
+		return err
+	}
+	endSession(s)
+	values := map[interface{}]interface{}{"sid": id}
+	for _, k := range sessionCarryOver {
+		if v, ok := s.Values[k]; ok {
+			values[k] = v
+		}
+	}
+	s.Values = values
+	s.IsNew = true
+	return nil
+}
+
+// endSession revokes s so its cookie is no longer accepted.
+func endSession(s *sessions.Session) {
+	if old, ok := s.Values["sid"].(string); ok {
+		revokedSessions.revoke(old)
+	}
+}
+
+// setReturnTo remembers where a visitor was going before being sent to sign in.
+func setReturnTo(s *sessions.Session, r *http.Request) {
+	if r.Method == "GET" {
+		s.Values["return-to"] = r.URL.RequestURI()
+	}
+}
+
+// takeReturnTo removes and returns the remembered path, or def. Only local
+// paths are returned.
+func takeReturnTo(s *sessions.Session, def string) string {
+	path, _ := s.Values["return-to"].(string)
+	delete(s.Values, "return-to")
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") || strings.HasPrefix(path, "/\\") {
+		return def
+	}
+	return path
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/gorilla/sessions"
+)
+
+func sessionCookie(t *testing.T, app *testApp) *http.Cookie {
+	t.Helper()
+	u, _ := url.Parse(app.URL)
+	for _, c := range app.client.Jar.Cookies(u) {
+		if c.Name == sessionName {
+			return c
+		}
+	}
+	t.Fatal("no session cookie")
+	return nil
+}
+
+func restoreCookie(app *testApp, c *http.Cookie) {
+	u, _ := url.Parse(app.URL)
+	app.client.Jar.SetCookies(u, []*http.Cookie{{Name: c.Name, Value: c.Value, Path: "/"}})
+}
+
+func TestLoginRegeneratesSession(t *testing.T) {
+	app := newTestApp(t)
+	app.login(t)
+	first := sessionCookie(t, app)
+	app.login(t)
+	second := sessionCookie(t, app)
+	if first.Value == second.Value {
+		t.Fatal("login kept the same session cookie")
+	}
+	restoreCookie(app, first)
+	if resp, _ := app.get(t, "/user"); resp.Request.URL.Path != "/" {
+		t.Errorf("replayed pre-login cookie reached %s", resp.Request.URL.Path)
+	}
+}
+
+func TestLogoutRevokesSession(t *testing.T) {
+	app := newTestApp(t)
+	app.login(t)
+	old := sessionCookie(t, app)
+	app.get(t, "/logout")
+	restoreCookie(app, old)
+	if resp, _ := app.get(t, "/user"); resp.Request.URL.Path != "/" {
+		t.Errorf("cookie replayed after logout reached %s", resp.Request.URL.Path)
+	}
+}
+
+func TestLoginReturnsToRequestedPage(t *testing.T) {
+	app := newTestApp(t)
+	if resp, _ := app.get(t, "/session?format=json"); resp.Request.URL.Path != "/" {
+		t.Fatalf("signed out visit ended at %s", resp.Request.URL.Path)
+	}
+	resp, _ := app.get(t, "/auth/heroku")
+	if got := resp.Request.URL.RequestURI(); got != "/session?format=json" {
+		t.Errorf("login ended at %s, want /session?format=json", got)
+	}
+	if resp, _ := app.get(t, "/auth/heroku"); resp.Request.URL.Path != "/user" {
+		t.Errorf("return-to was reused: second login ended at %s", resp.Request.URL.Path)
+	}
+}
+
+func TestRegenerateSession(t *testing.T) {
+	s := sessions.NewSession(store, sessionName)
+	s.Values["sid"] = "old"
+	s.Values["accounts"] = []*account{}
+	s.Values["planted"] = "value"
+	if err := regenerateSession(s); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Values["planted"]; ok {
+		t.Error("unknown value was carried over")
+	}
+	if _, ok := s.Values["accounts"]; !ok {
+		t.Error("accounts were not carried over")
+	}
+	if id, _ := s.Values["sid"].(string); id == "" || id == "old" {
+		t.Errorf("sid = %q", id)
+	}
+	if !revokedSessions.revoked("old") {
+		t.Error("old session was not revoked")
+	}
+}
+
+func TestTakeReturnTo(t *testing.T) {
+	for path, want := range map[string]string{
+		"/teams":               "/teams",
+		"//evil.example":       "/user",
+		"/\\evil.example":      "/user",
+		"https://evil.example": "/user",
+		"":                     "/user",
+	} {
+		s := sessions.NewSession(store, sessionName)
+		s.Values["return-to"] = path
+		if got := takeReturnTo(s, "/user"); got != want {
+			t.Errorf("takeReturnTo(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+var (
+	ssoSalt    = getenv("SSO_SALT")
+	addonID    = getenvDefault("ADDON_ID", "heroku-oauth-example-go")
+	ssoMaxSkew = 5 * time.Minute
+)
+
+// ssoLogin is the add-on resource a user signed in to through Heroku's
+// add-on partner single sign-on.
+type ssoLogin struct {
+	ResourceID string
+	Email      string
+	UserID     string
+	AppName    string
+	At         time.Time
+}
+
+func init() {
+	gob.Register(&ssoLogin{})
+}
+
+// ssoToken returns the resource_token Heroku sends for id at timestamp.
+// See https://devcenter.heroku.com/articles/add-on-single-sign-on
+func ssoToken(id, timestamp string) string {
+	sum := sha1.Sum([]byte(id + ":" + ssoSalt + ":" + timestamp))
+	return hex.EncodeToString(sum[:])
+}
+
+func handleSSOLogin(w http.ResponseWriter, r *http.Request) {
+	if ssoSalt == "" {
+		http.Error(w, "Single sign-on is not configured", http.StatusNotFound)
+		return
+	}
+	id := r.FormValue("resource_id")
+	timestamp := r.FormValue("timestamp")
+	fail := func(msg string) {
+		audits.record(r, nil, auditEvent{Action: "sso.login", Target: id, Outcome: auditDenied, Detail: msg})
+		http.Error(w, msg, http.StatusForbidden)
+	}
+	if id == "" {
+		fail("Missing resource_id")
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(ssoToken(id, timestamp)), []byte(r.FormValue("resource_token"))) != 1 {
+		fail("Invalid resource_token")
+		return
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		fail("Invalid timestamp")
+		return
+	}
+	if d := time.Since(time.Unix(ts, 0)); d > ssoMaxSkew || d < -ssoMaxSkew {
+		fail("Expired timestamp")
+		return
+	}
+
+	session, err := loadSession(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := regenerateSession(session); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	login := &ssoLogin{
+		ResourceID: id,
+		Email:      r.FormValue("email"),
+		UserID:     r.FormValue("user_id"),
+		AppName:    r.FormValue("app"),
+		At:         time.Now(),
+	}
+	session.Values["sso"] = login
+	if _, ok := session.Values["created"]; !ok {
+		session.Values["created"] = time.Now()
+	}
+	startSession(session, time.Now())
+	if err := session.Save(r, w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Boomerang reads the nav data from script, so it can't be HttpOnly.
+	http.SetCookie(w, &http.Cookie{Name: "heroku-nav-data", Value: r.FormValue("nav-data"), Path: "/", Secure: !devMode})
+	audits.record(r, nil, auditEvent{Action: "sso.login", ActorID: login.UserID, ActorEmail: login.Email, Target: id, Outcome: auditSuccess})
+	http.Redirect(w, r, "/sso/resource", http.StatusFound)
+}
+
+func currentSSOLogin(s *sessions.Session) (*ssoLogin, bool) {
+	login, ok := s.Values["sso"].(*ssoLogin)
+	return login, ok
+}
+
+// writeHerokuNav renders the Heroku navigation header add-on dashboards are
+// expected to show. See https://devcenter.heroku.com/articles/add-on-single-sign-on#the-heroku-nav-header
+func writeHerokuNav(w http.ResponseWriter, login *ssoLogin) {
+	// The app name comes unsigned from the SSO form; JSON keeps it a string
+	// and escapes <, > and & so it can't close the script either.
+	opts, _ := json.Marshal(map[string]string{"app": login.AppName, "addon": addonID})
+	fmt.Fprintf(w, `<script src="https://s3.amazonaws.com/assets.heroku.com/boomerang/boomerang.js"></script>`+
+		`<script>document.addEventListener("DOMContentLoaded", function() { Boomerang.init(%s); });</script>`, opts)
+}
+
+func handleSSOResource(w http.ResponseWriter, r *http.Request) {
+	session, err := loadSession(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	login, ok := currentSSOLogin(session)
+	if !ok {
+		http.Error(w, "Sign in from the Heroku dashboard", http.StatusForbidden)
+		return
+	}
+	fmt.Fprint(w, `<html><head>`)
+	writeHerokuNav(w, login)
+	fmt.Fprintf(w, `</head><body><h1>%s</h1><p>Signed in as %s for %s.</p></body></html>`,
+		html.EscapeString(login.ResourceID), html.EscapeString(login.Email), html.EscapeString(login.AppName))
+}
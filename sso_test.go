@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSSOLogin(t *testing.T) {
+	savedSalt := ssoSalt
+	defer func() { ssoSalt = savedSalt }()
+	ssoSalt = "salt"
+
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	stale := strconv.FormatInt(time.Now().Add(-10*time.Minute).Unix(), 10)
+	for _, tt := range []struct {
+		name      string
+		timestamp string
+		token     string
+		status    int
+	}{
+		{"valid", now, ssoToken("resource-1", now), http.StatusOK},
+		{"bad token", now, ssoToken("resource-2", now), http.StatusForbidden},
+		{"stale", stale, ssoToken("resource-1", stale), http.StatusForbidden},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+			resp, err := app.client.PostForm(app.URL+"/sso/login", url.Values{
+				"resource_id":    {"resource-1"},
+				"timestamp":      {tt.timestamp},
+				"resource_token": {tt.token},
+				"email":          {"user@example.com"},
+				"app":            {"example"},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Fatalf("POST /sso/login = %d, want %d", resp.StatusCode, tt.status)
+			}
+			resp, body := app.get(t, "/sso/resource")
+			if signedIn := resp.StatusCode == http.StatusOK && strings.Contains(body, "Boomerang.init"); signedIn != (tt.status == http.StatusOK) {
+				t.Errorf("GET /sso/resource = %d: %s", resp.StatusCode, body)
+			}
+		})
+	}
+}
+
+func TestSSONav(t *testing.T) {
+	savedSalt := ssoSalt
+	defer func() { ssoSalt = savedSalt }()
+	ssoSalt = "salt"
+
+	app := newTestApp(t)
+	noFollow := *app.client
+	noFollow.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	resp, err := noFollow.PostForm(app.URL+"/sso/login", url.Values{
+		"resource_id":    {"resource-1"},
+		"timestamp":      {now},
+		"resource_token": {ssoToken("resource-1", now)},
+		"email":          {"user@example.com"},
+		"app":            {`x"});alert(1)//</script>`},
+		"nav-data":       {"nav"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	var nav *http.Cookie
+	for _, c := range resp.Cookies() {
+		if c.Name == "heroku-nav-data" {
+			nav = c
+		}
+	}
+	if nav == nil || nav.HttpOnly || !nav.Secure {
+		t.Errorf("nav cookie = %+v, want Secure and readable from script", nav)
+	}
+
+	_, body := app.get(t, "/sso/resource")
+	if strings.Contains(body, "alert(1)") && !strings.Contains(body, `"app":"x\"});alert(1)//\u003c/script\u003e"`) {
+		t.Errorf("app name escaped the Boomerang options: %s", body)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/sessions"
+)
+
+// team is a Heroku team along with the signed in user's role in it.
+type team struct { // See https://devcenter.heroku.com/articles/platform-api-reference#team
+	ID                string `json:"id"`
+	Name              string `json:"name"`
+	Role              string `json:"role"`
+	EnterpriseAccount *struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"enterprise_account"`
+}
+
+type teamMember struct { // See https://devcenter.heroku.com/articles/platform-api-reference#team-member
+	Email string `json:"email"`
+	Role  string `json:"role"`
+	User  struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"user"`
+}
+
+type teamApp struct { // See https://devcenter.heroku.com/articles/platform-api-reference#team-app
+	Name   string `json:"name"`
+	WebURL string `json:"web_url"`
+}
+
+type enterpriseAccount struct { // See https://devcenter.heroku.com/articles/platform-api-reference#enterprise-account
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type enterpriseMember struct { // See https://devcenter.heroku.com/articles/platform-api-reference#enterprise-account-member
+	User struct {
+		Email string `json:"email"`
+	} `json:"user"`
+	Permissions []struct {
+		Name string `json:"name"`
+	} `json:"permissions"`
+}
+
+// userTeams returns the teams client's user belongs to, including their role
+// in each.
+func userTeams(client *http.Client) ([]team, error) {
+	var teams []team
+	err := herokuGet(client, "/teams", &teams)
+	return teams, err
+}
+
+// teamRole returns the user's role ("admin", "member", ...) in the named
+// team, or "" if they are not a member. Handlers use it to tell team admins
+// apart from members.
+func teamRole(client *http.Client, name string) (string, error) {
+	teams, err := userTeams(client)
+	if err != nil {
+		return "", err
+	}
+	for _, t := range teams {
+		if t.Name == name || t.ID == name {
+			return t.Role, nil
+		}
+	}
+	return "", nil
+}
+
+// herokuClient returns a's API client, rejecting accounts from other
+// providers.
+func herokuClient(ctx context.Context, a *account) (*http.Client, error) {
+	if a.Provider != "heroku" {
+		return nil, fmt.Errorf("%s is not a Heroku account", a.label())
+	}
+	return a.client(ctx)
+}
+
+func handleTeams(w http.ResponseWriter, r *http.Request, s *sessions.Session, a *account) {
+	ctx, cancel := outboundContext(r.Context(), apiTimeout)
+	defer cancel()
+	client, err := herokuClient(ctx, a)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	name := r.PathValue("team")
+	if name == "" {
+		teams, err := userTeams(client)
+		if err != nil {
+			apiError(w, err)
+			return
+		}
+		fmt.Fprint(w, `<html><body>`)
+		writeAccountBar(w, s, a)
+		fmt.Fprint(w, `<h1>Teams</h1><ul>`)
+		for _, t := range teams {
+			fmt.Fprintf(w, `<li><a href="/teams/%s">%s</a> (%s)</li>`, url.PathEscape(t.Name), html.EscapeString(t.Name), html.EscapeString(t.Role))
+		}
+		fmt.Fprint(w, `</ul><p><a href="/enterprise">Enterprise accounts</a></p></body></html>`)
+		return
+	}
+
+	role, err := teamRole(client, name)
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+	if role == "" {
+		http.Error(w, "You are not a member of "+name, http.StatusNotFound)
+		return
+	}
+	var members []teamMember
+	if err := herokuGet(client, "/teams/"+url.PathEscape(name)+"/members", &members); err != nil {
+		apiError(w, err)
+		return
+	}
+	var apps []teamApp
+	if err := herokuGet(client, "/teams/"+url.PathEscape(name)+"/apps", &apps); err != nil {
+		apiError(w, err)
+		return
+	}
+	fmt.Fprint(w, `<html><body>`)
+	writeAccountBar(w, s, a)
+	fmt.Fprintf(w, `<h1>%s</h1><p>Your role: %s</p><h2>Members</h2><table><tr><th>Email</th><th>Name</th><th>Role</th></tr>`, html.EscapeString(name), html.EscapeString(role))
+	for _, m := range members {
+		fmt.Fprintf(w, `<tr><td>%s</td><td>%s</td><td>%s</td></tr>`, html.EscapeString(m.Email), html.EscapeString(m.User.Name), html.EscapeString(m.Role))
+	}
+	fmt.Fprint(w, `</table><h2>Apps</h2><ul>`)
+	for _, app := range apps {
+		fmt.Fprintf(w, `<li><a href="%s">%s</a> (<a href="/apps/%s/webhooks">webhooks</a>)</li>`, html.EscapeString(app.WebURL), html.EscapeString(app.Name), url.PathEscape(app.Name))
+	}
+	fmt.Fprint(w, `</ul></body></html>`)
+}
+
+func handleEnterprise(w http.ResponseWriter, r *http.Request, s *sessions.Session, a *account) {
+	ctx, cancel := outboundContext(r.Context(), apiTimeout)
+	defer cancel()
+	client, err := herokuClient(ctx, a)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	id := r.PathValue("id")
+	if id == "" {
+		var accounts []enterpriseAccount
+		if err := herokuGet(client, "/enterprise-accounts", &accounts); err != nil {
+			apiError(w, err)
+			return
+		}
+		fmt.Fprint(w, `<html><body>`)
+		writeAccountBar(w, s, a)
+		fmt.Fprint(w, `<h1>Enterprise accounts</h1><ul>`)
+		for _, e := range accounts {
+			fmt.Fprintf(w, `<li><a href="/enterprise/%s">%s</a></li>`, url.PathEscape(e.ID), html.EscapeString(e.Name))
+		}
+		fmt.Fprint(w, `</ul></body></html>`)
+		return
+	}
+
+	var teams []team
+	if err := herokuGet(client, "/enterprise-accounts/"+url.PathEscape(id)+"/teams", &teams); err != nil {
+		apiError(w, err)
+		return
+	}
+	var members []enterpriseMember
+	if err := herokuGet(client, "/enterprise-accounts/"+url.PathEscape(id)+"/members", &members); err != nil {
+		apiError(w, err)
+		return
+	}
+	fmt.Fprint(w, `<html><body>`)
+	writeAccountBar(w, s, a)
+	fmt.Fprint(w, `<h1>Enterprise account</h1><h2>Teams</h2><ul>`)
+	for _, t := range teams {
+		fmt.Fprintf(w, `<li><a href="/teams/%s">%s</a></li>`, url.PathEscape(t.Name), html.EscapeString(t.Name))
+	}
+	fmt.Fprint(w, `</ul><h2>Members</h2><table><tr><th>Email</th><th>Permissions</th></tr>`)
+	for _, m := range members {
+		var perms []string
+		for _, p := range m.Permissions {
+			perms = append(perms, p.Name)
+		}
+		fmt.Fprintf(w, `<tr><td>%s</td><td>%s</td></tr>`, html.EscapeString(m.User.Email), html.EscapeString(strings.Join(perms, ", ")))
+	}
+	fmt.Fprint(w, `</table></body></html>`)
+}
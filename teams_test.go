@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestTeams(t *testing.T) {
+	app := newTestApp(t)
+	app.heroku.Teams = []fakeTeam{
+		{ID: "team-1", Name: "ops", Role: "admin", Apps: []string{"ops-api"}},
+		{ID: "team-2", Name: "dev", Role: "member"},
+	}
+	app.login(t)
+
+	resp, body := app.get(t, "/teams")
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, `<a href="/teams/ops">ops</a> (admin)`) || !strings.Contains(body, `<a href="/teams/dev">dev</a> (member)`) {
+		t.Errorf("GET /teams = %d: %s", resp.StatusCode, body)
+	}
+
+	resp, body = app.get(t, "/teams/ops")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /teams/ops = %d: %s", resp.StatusCode, body)
+	}
+	for _, want := range []string{"Your role: admin", "user@example.com", "ops-api", "/apps/ops-api/webhooks"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("team page does not show %q: %s", want, body)
+		}
+	}
+	if _, body := app.get(t, "/teams/dev"); !strings.Contains(body, "Your role: member") {
+		t.Errorf("member's team page: %s", body)
+	}
+	if resp, _ := app.get(t, "/teams/other"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET /teams/other = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestEnterprise(t *testing.T) {
+	app := newTestApp(t)
+	app.heroku.Teams = []fakeTeam{
+		{ID: "team-1", Name: "ops", Role: "admin", Enterprise: "acme"},
+		{ID: "team-2", Name: "dev", Role: "member"},
+	}
+	app.login(t)
+
+	resp, body := app.get(t, "/enterprise")
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, `<a href="/enterprise/acme">acme</a>`) {
+		t.Errorf("GET /enterprise = %d: %s", resp.StatusCode, body)
+	}
+
+	resp, body = app.get(t, "/enterprise/acme")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /enterprise/acme = %d: %s", resp.StatusCode, body)
+	}
+	if !strings.Contains(body, `<a href="/teams/ops">ops</a>`) || strings.Contains(body, "/teams/dev") {
+		t.Errorf("enterprise page lists the wrong teams: %s", body)
+	}
+	if !strings.Contains(body, "<td>user@example.com</td><td>view</td>") {
+		t.Errorf("enterprise page does not list member permissions: %s", body)
+	}
+}
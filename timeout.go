@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+var (
+	sessionIdleTimeout    = durationEnv("SESSION_IDLE_TIMEOUT", 30*time.Minute)
+	sessionMaxAge         = durationEnv("SESSION_MAX_AGE", 7*24*time.Hour)
+	sessionRememberMaxAge = durationEnv("SESSION_REMEMBER_MAX_AGE", 30*24*time.Hour)
+	sessionExpiryWarning  = durationEnv("SESSION_EXPIRY_WARNING", time.Hour)
+)
+
+// sessionLifetime is the longest any session can last, which bounds how
+// long the store accepts a cookie.
+func sessionLifetime() time.Duration {
+	if sessionRememberMaxAge > sessionMaxAge {
+		return sessionRememberMaxAge
+	}
+	return sessionMaxAge
+}
+
+// startSession starts the absolute and idle clocks of a signed in session.
+// Remembered sessions get the longer absolute limit; the idle limit is the
+// same for both.
+func startSession(s *sessions.Session, now time.Time) {
+	maxAge := sessionMaxAge
+	if remember, _ := s.Values["remember"].(bool); remember {
+		maxAge = sessionRememberMaxAge
+	}
+	s.Values["expires"] = now.Add(maxAge)
+	s.Values["seen"] = now
+	s.Options.MaxAge = cookieMaxAge(s, now)
+}
+
+// sessionDeadlines returns when s ends for inactivity and when it ends
+// regardless. ok is false for sessions that were never started.
+func sessionDeadlines(s *sessions.Session) (idle, absolute time.Time, ok bool) {
+	absolute, ok = s.Values["expires"].(time.Time)
+	seen, _ := s.Values["seen"].(time.Time)
+	return seen.Add(sessionIdleTimeout), absolute, ok
+}
+
+// cookieMaxAge lets the browser drop the cookie when s would expire anyway.
+func cookieMaxAge(s *sessions.Session, now time.Time) int {
+	idle, absolute, _ := sessionDeadlines(s)
+	if absolute.Before(idle) {
+		idle = absolute
+	}
+	return int(idle.Sub(now) / time.Second)
+}
+
+// sessionTimeouts ends sessions that have been idle or alive too long and
+// slides the idle deadline on activity. The cookie is only rewritten once
+// a sixth of the idle timeout has passed since it was last renewed.
+func sessionTimeouts(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := r.Cookie(sessionName); err == nil {
+			checkSessionTimeouts(w, r, time.Now())
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func checkSessionTimeouts(w http.ResponseWriter, r *http.Request, now time.Time) {
+	s, err := loadSession(r)
+	if err != nil {
+		return
+	}
+	idle, absolute, ok := sessionDeadlines(s)
+	if !ok {
+		return
+	}
+	if now.After(idle) || now.After(absolute) {
+		reason := "idle"
+		if now.After(absolute) {
+			reason = "absolute"
+		}
+		for _, a := range sessionAccounts(s) {
+			audits.record(r, a, auditEvent{Action: "session.expire", Target: a.Provider, Outcome: auditSuccess, Detail: reason})
+		}
+		endSession(s)
+		s.Values = map[interface{}]interface{}{}
+		s.Options.MaxAge = -1
+		if err := s.Save(r, w); err != nil {
+			log.Printf("expiring session: %v", err)
+		}
+		// Later saves in this request start a new session.
+		s.Options.MaxAge = store.Options.MaxAge
+		s.IsNew = true
+		return
+	}
+	seen, _ := s.Values["seen"].(time.Time)
+	if now.Sub(seen) >= sessionIdleTimeout/6 {
+		s.Values["seen"] = now
+		s.Options.MaxAge = cookieMaxAge(s, now)
+		if err := s.Save(r, w); err != nil {
+			log.Printf("renewing session: %v", err)
+		}
+		return
+	}
+	s.Options.MaxAge = cookieMaxAge(s, now)
+}
+
+// writeExpiryWarning warns when the session's absolute limit is close.
+// Signing in again starts a new one.
+func writeExpiryWarning(w io.Writer, s *sessions.Session, a *account, now time.Time) {
+	_, absolute, ok := sessionDeadlines(s)
+	if !ok || absolute.Sub(now) > sessionExpiryWarning {
+		return
+	}
+	fmt.Fprintf(w, `<p style="background:#fff3cd;padding:0.5em">Your session ends in %s. <a href="/auth/%s">Sign in again</a> to stay signed in.</p>`,
+		absolute.Sub(now).Round(time.Minute), html.EscapeString(a.Provider))
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func withSessionTimeouts(t *testing.T, idle, maxAge, remember time.Duration) {
+	saved := []time.Duration{sessionIdleTimeout, sessionMaxAge, sessionRememberMaxAge, sessionExpiryWarning}
+	t.Cleanup(func() {
+		sessionIdleTimeout, sessionMaxAge, sessionRememberMaxAge, sessionExpiryWarning = saved[0], saved[1], saved[2], saved[3]
+	})
+	sessionIdleTimeout, sessionMaxAge, sessionRememberMaxAge = idle, maxAge, remember
+}
+
+func signedIn(t *testing.T, app *testApp) bool {
+	t.Helper()
+	resp, _ := app.get(t, "/user")
+	return resp.Request.URL.Path == "/user"
+}
+
+func TestIdleTimeout(t *testing.T) {
+	app := newTestApp(t)
+	withSessionTimeouts(t, 500*time.Millisecond, time.Hour, time.Hour)
+	app.login(t)
+	for i := 0; i < 5; i++ {
+		time.Sleep(200 * time.Millisecond)
+		if !signedIn(t, app) {
+			t.Fatalf("signed out after %d active requests", i)
+		}
+	}
+	time.Sleep(700 * time.Millisecond)
+	if signedIn(t, app) {
+		t.Error("still signed in after the idle timeout")
+	}
+}
+
+func TestAbsoluteTimeout(t *testing.T) {
+	app := newTestApp(t)
+	withSessionTimeouts(t, time.Hour, 500*time.Millisecond, time.Hour)
+	app.login(t)
+	time.Sleep(700 * time.Millisecond)
+	if signedIn(t, app) {
+		t.Error("still signed in after the absolute timeout")
+	}
+
+	if resp, _ := app.get(t, "/auth/heroku?remember=1"); resp.Request.URL.Path != "/user" {
+		t.Fatalf("remembered login ended at %s", resp.Request.URL.Path)
+	}
+	time.Sleep(700 * time.Millisecond)
+	if !signedIn(t, app) {
+		t.Error("remembered session ended at the normal absolute timeout")
+	}
+}
+
+func TestSessionRenewal(t *testing.T) {
+	app := newTestApp(t)
+	app.login(t)
+	resp, _ := app.get(t, "/user")
+	for _, c := range resp.Cookies() {
+		if c.Name == sessionName {
+			t.Error("session cookie rewritten on a request well inside the idle timeout")
+		}
+	}
+}
+
+func TestExpiryWarning(t *testing.T) {
+	app := newTestApp(t)
+	app.login(t)
+	if _, body := app.get(t, "/user"); strings.Contains(body, "Your session ends") {
+		t.Error("warning shown a week before expiry")
+	}
+	withSessionTimeouts(t, sessionIdleTimeout, sessionMaxAge, sessionRememberMaxAge)
+	sessionExpiryWarning = 8 * 24 * time.Hour
+	if _, body := app.get(t, "/user"); !strings.Contains(body, "Your session ends in") {
+		t.Error("no warning inside the warning window")
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// storedUser is a Heroku user the app can act for while they are away.
+type storedUser struct {
+	ID           string    `json:"id"`
+	Email        string    `json:"email"`
+	Name         string    `json:"name"`
+	Scopes       []string  `json:"scopes"`
+	RefreshToken string    `json:"refresh_token"` // encrypted with the store's key
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+	LastLoginAt  time.Time `json:"last_login_at"`
+}
+
+// userStore persists Heroku users and their refresh tokens, keyed by
+// account ID, in a JSON file. Refresh tokens are encrypted with AES-GCM.
+type userStore struct {
+	path string
+	sealer
+
+	mu      sync.Mutex
+	loaded  bool
+	version fileVersion // of path when last read
+	users   map[string]*storedUser
+}
+
+var errUnknownUser = errors.New("unknown user")
+
+// users is nil unless USER_STORE_KEY holds a hex encoded 16, 24 or 32 byte
+// key.
+var users = openUserStore(getenvDefault("USER_STORE", "users.json"), getenv("USER_STORE_KEY"))
+
+func openUserStore(path, hexKey string) *userStore {
+	if hexKey == "" {
+		return nil
+	}
+	s, err := newUserStore(path, hexKey)
+	if err != nil {
+		log.Fatalf("USER_STORE_KEY: %v", err)
+	}
+	return s
+}
+
+func newUserStore(path, hexKey string) (*userStore, error) {
+	sealer, err := newSealer(hexKey)
+	if err != nil {
+		return nil, err
+	}
+	return &userStore{path: path, sealer: sealer}, nil
+}
+
+func (s *userStore) load() error {
+	changed, err := jsonFileChanged(s.path, &s.version)
+	if err != nil {
+		return err
+	}
+	if s.loaded && !changed {
+		return nil
+	}
+	s.users = map[string]*storedUser{}
+	s.loaded = false
+	if err := readJSONFile(s.path, &s.users); err != nil {
+		return err
+	}
+	s.loaded = true
+	return nil
+}
+
+// saveLogin records a sign in by a, replacing the stored refresh token.
+func (s *userStore) saveLogin(a *account) error {
+	if a.Token.RefreshToken == "" {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return err
+	}
+	sealed, err := s.encrypt(a.Identity.ID, a.Token.RefreshToken)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	u, ok := s.users[a.Identity.ID]
+	if !ok {
+		u = &storedUser{ID: a.Identity.ID, CreatedAt: now}
+		s.users[u.ID] = u
+	}
+	u.Email, u.Name, u.Scopes = a.Identity.Email, a.Identity.Name, a.Scopes
+	u.RefreshToken, u.UpdatedAt, u.LastLoginAt = sealed, now, now
+	return writeJSONFile(s.path, s.users)
+}
+
+// user returns a copy of the stored user with id, without their token.
+func (s *userStore) user(id string) (storedUser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return storedUser{}, err
+	}
+	u, ok := s.users[id]
+	if !ok {
+		return storedUser{}, errUnknownUser
+	}
+	c := *u
+	c.RefreshToken = ""
+	return c, nil
+}
+
+// ids returns the IDs of every stored user.
+func (s *userStore) ids() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	var ids []string
+	for id := range s.users {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (s *userStore) delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return err
+	}
+	delete(s.users, id)
+	return writeJSONFile(s.path, s.users)
+}
+
+func (s *userStore) refreshToken(id string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return "", err
+	}
+	u, ok := s.users[id]
+	if !ok {
+		return "", errUnknownUser
+	}
+	return s.decrypt(id, u.RefreshToken)
+}
+
+func (s *userStore) updateRefreshToken(id, token string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return err
+	}
+	u, ok := s.users[id]
+	if !ok {
+		return errUnknownUser
+	}
+	sealed, err := s.encrypt(id, token)
+	if err != nil {
+		return err
+	}
+	u.RefreshToken, u.UpdatedAt = sealed, time.Now()
+	return writeJSONFile(s.path, s.users)
+}
+
+// tokenSource returns a token source acting as the stored user with id,
+// for use by background work when the user is not present. The first call
+// to Token refreshes; if Heroku issues a new refresh token it is stored.
+func (s *userStore) tokenSource(ctx context.Context, id string) (oauth2.TokenSource, error) {
+	rt, err := s.refreshToken(id)
+	if err != nil {
+		return nil, fmt.Errorf("loading token for %s: %v", id, err)
+	}
+	src := &storedTokenSource{ctx: ctx, store: s, id: id, rt: rt}
+	return oauth2.ReuseTokenSource(nil, src), nil
+}
+
+type storedTokenSource struct {
+	ctx   context.Context
+	store *userStore
+	id    string
+	rt    string
+}
+
+func (s *storedTokenSource) Token() (*oauth2.Token, error) {
+	t, err := sharedRefresh(s.ctx, oauthConfig, s.rt)
+	if err != nil {
+		return nil, err
+	}
+	if t.RefreshToken != "" && t.RefreshToken != s.rt {
+		if err := s.store.updateRefreshToken(s.id, t.RefreshToken); err != nil {
+			log.Printf("storing refreshed token for %s: %v", s.id, err)
+		}
+		s.rt = t.RefreshToken
+	}
+	return t, nil
+}
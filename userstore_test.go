@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func TestUserStoreOfflineAccess(t *testing.T) {
+	app := newTestApp(t)
+	app.heroku.setRotateRefresh(true)
+	path := filepath.Join(t.TempDir(), "users.json")
+	s, err := newUserStore(path, strings.Repeat("ab", 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := users
+	users = s
+	defer func() { users = saved }()
+
+	app.login(t)
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "refresh-") {
+		t.Errorf("user store holds a plaintext refresh token: %s", b)
+	}
+	u, err := users.user(app.heroku.User.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Email != app.heroku.User.Email || u.LastLoginAt.IsZero() {
+		t.Errorf("stored user = %+v", u)
+	}
+
+	// Each token source refreshes, rotating the refresh token; a second
+	// source only works if the rotated token was stored.
+	for i := 0; i < 2; i++ {
+		src, err := users.tokenSource(context.Background(), app.heroku.User.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, err := identifyHeroku(context.Background(), oauth2.NewClient(context.Background(), src))
+		if err != nil {
+			t.Fatalf("acting as the stored user: %v", err)
+		}
+		if id.ID != app.heroku.User.ID {
+			t.Errorf("acted as %s, want %s", id.ID, app.heroku.User.ID)
+		}
+	}
+	if n := app.heroku.refreshCount(); n != 2 {
+		t.Errorf("refreshed %d times, want 2", n)
+	}
+
+	if _, err := users.tokenSource(context.Background(), "nobody"); err == nil {
+		t.Error("got a token source for an unknown user")
+	}
+}
+
+func TestUserStoreRejectsMovedToken(t *testing.T) {
+	s, err := newUserStore(filepath.Join(t.TempDir(), "users.json"), strings.Repeat("ab", 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := s.encrypt("alice", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.decrypt("bob", sealed); err == nil {
+		t.Error("decrypted a token stored for another user")
+	}
+	if got, err := s.decrypt("alice", sealed); err != nil || got != "token" {
+		t.Errorf("decrypt = %q, %v", got, err)
+	}
+}
+
+func TestUserStoreSharedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	key := strings.Repeat("ab", 16)
+	web, _ := newUserStore(path, key)
+	worker, _ := newUserStore(path, key)
+	if ids, err := worker.ids(); err != nil || len(ids) != 0 {
+		t.Fatalf("ids = %v, %v", ids, err)
+	}
+
+	// A user who signs in after the worker started is visible to it.
+	a := &account{Identity: identity{ID: "u1", Email: "user@example.com"}, Token: &oauth2.Token{RefreshToken: "refresh"}}
+	if err := web.saveLogin(a); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := worker.refreshToken("u1"); err != nil || got != "refresh" {
+		t.Errorf("worker refreshToken = %q, %v", got, err)
+	}
+}
@@ -2,104 +2,329 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/gob"
-	"encoding/json"
+	"expvar"
 	"fmt"
+	"html"
+	"log"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 
+	gcontext "github.com/gorilla/context"
 	"github.com/gorilla/sessions"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/heroku"
 )
 
 var (
-	store = sessions.NewCookieStore([]byte(os.Getenv("COOKIE_SECRET")), []byte(os.Getenv("COOKIE_ENCRYPT")))
+	appURL = defaultAppURL()
+
+	store, cookieKeysErr = newCookieStore()
 
 	oauthConfig = &oauth2.Config{
-		ClientID:     os.Getenv("HEROKU_OAUTH_ID"),
-		ClientSecret: os.Getenv("HEROKU_OAUTH_SECRET"),
-		Endpoint:     heroku.Endpoint,
-		Scopes:       []string{"identity"},                                                            // See https://devcenter.heroku.com/articles/oauth#scopes
-		RedirectURL:  "http://" + os.Getenv("HEROKU_APP_NAME") + "herokuapp.com/auth/heroku/callback", // See https://devcenter.heroku.com/articles/dyno-metadata
+		ClientID:     getenv("HEROKU_OAUTH_ID"),
+		ClientSecret: getenv("HEROKU_OAUTH_SECRET"),
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  getenvDefault("HEROKU_OAUTH_AUTH_URL", heroku.Endpoint.AuthURL),
+			TokenURL: getenvDefault("HEROKU_OAUTH_TOKEN_URL", heroku.Endpoint.TokenURL),
+		},
+		Scopes:      strings.Fields(getenvDefault("HEROKU_OAUTH_SCOPES", "identity read")), // See https://devcenter.heroku.com/articles/oauth#scopes
+		RedirectURL: appURL + "/auth/heroku/callback",
 	}
-
-	stateToken = os.Getenv("HEROKU_APP_NAME")
 )
 
+func defaultAppURL() string {
+	if devMode {
+		return "http://localhost:" + getenvDefault("PORT", "5000")
+	}
+	return "http://" + getenv("HEROKU_APP_NAME") + ".herokuapp.com" // See https://devcenter.heroku.com/articles/dyno-metadata
+}
+
+func getenvDefault(key, def string) string {
+	if v := getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
 func init() {
 	gob.Register(&oauth2.Token{})
+	gob.Register(time.Time{})
 
-	store.MaxAge(60 * 60 * 8)
-	store.Options.Secure = true
+	store.MaxAge(int(sessionLifetime() / time.Second))
+	configureCookies(store.Options)
 }
 
 func handleRoot(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprint(w, `<html><body><a href="/auth/heroku">Sign in with Heroku</a></body></html>`)
+	fmt.Fprint(w, `<html><body>`)
+	if mockMode {
+		fmt.Fprint(w, `<p style="background:#fff3cd;padding:0.5em"><strong>Mock mode.</strong> Heroku sign in and API calls are served by canned data.</p>`)
+	}
+	fmt.Fprint(w, `<form method="get">`)
+	for _, p := range sortedProviders() {
+		fmt.Fprintf(w, `<p><button formaction="/auth/%s">Sign in with %s</button></p>`, p.Name, html.EscapeString(p.Title))
+	}
+	fmt.Fprint(w, `<p><label><input type="checkbox" name="remember" value="1"> Remember me</label></p></form></body></html>`)
 }
 
-func handleAuth(w http.ResponseWriter, r *http.Request) {
-	url := oauthConfig.AuthCodeURL(stateToken)
-	http.Redirect(w, r, url, http.StatusFound)
+// withProvider resolves the {provider} in /auth/{provider} routes.
+func withProvider(h func(http.ResponseWriter, *http.Request, *provider)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, ok := lookupProvider(r.PathValue("provider"))
+		if !ok {
+			handleNotFound(w, r)
+			return
+		}
+		h(w, r, p)
+	}
 }
 
-func handleAuthCallback(w http.ResponseWriter, r *http.Request) {
-	if v := r.FormValue("state"); v != stateToken {
-		http.Error(w, "Invalid State token", http.StatusBadRequest)
-		return
+func handleAuth(w http.ResponseWriter, r *http.Request, p *provider) {
+	var opts []oauth2.AuthCodeOption
+	if r.FormValue("add") != "" {
+		opts = append(opts, oauth2.SetAuthURLParam("prompt", "login")) // Ask for a different login than the one already linked
 	}
-	ctx := context.Background()
-	token, err := oauthConfig.Exchange(ctx, r.FormValue("code"))
+	session, err := loadSession(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	session, err := store.Get(r, "heroku-oauth-example-go")
+	if r.FormValue("remember") != "" {
+		session.Values["remember"] = true
+	} else {
+		delete(session.Values, "remember")
+	}
+	// The state ties the callback to this browser, so nobody can complete a
+	// login of their own choosing in someone else's session.
+	state, err := randomHex(16)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	session.Values["heroku-oauth-token"] = token
+	session.Values["oauth-state"] = p.Name + " " + state
 	if err := session.Save(r, w); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	http.Redirect(w, r, "/user", http.StatusFound)
+	url := p.Config.AuthCodeURL(state, opts...)
+	http.Redirect(w, r, url, http.StatusFound)
 }
 
-func handleUser(w http.ResponseWriter, r *http.Request) {
-	session, err := store.Get(r, "heroku-oauth-example-go")
+func handleAuthCallback(w http.ResponseWriter, r *http.Request, p *provider) {
+	fail := func(a *account, e callbackError, err error) {
+		logCallbackError(p, e, err)
+		audits.record(r, a, auditEvent{Action: "login", Target: p.Name, Outcome: auditFailure, Detail: e.Kind})
+		e.render(w, p)
+	}
+	session, err := loadSession(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		fail(nil, errCallbackInternal, err)
+		return
+	}
+	want, _ := session.Values["oauth-state"].(string)
+	if want == "" || subtle.ConstantTimeCompare([]byte(want), []byte(p.Name+" "+r.FormValue("state"))) != 1 {
+		fail(nil, errCallbackState, nil)
+		return
+	}
+	// Each state is good for one callback.
+	delete(session.Values, "oauth-state")
+	if err := session.Save(r, w); err != nil {
+		fail(nil, errCallbackInternal, err)
+		return
+	}
+	if code := r.FormValue("error"); code != "" {
+		fail(nil, providerCallbackError(code), fmt.Errorf("%s: %s", code, r.FormValue("error_description")))
+		return
+	}
+	ctx, cancel := outboundContext(r.Context(), exchangeTimeout)
+	token, err := p.Config.Exchange(ctx, r.FormValue("code"))
+	cancel()
+	if err != nil {
+		fail(nil, exchangeError(err), err)
 		return
 	}
-	token, ok := session.Values["heroku-oauth-token"].(*oauth2.Token)
+	a := &account{Provider: p.Name, Token: token, Scopes: p.Config.Scopes, LinkedAt: time.Now()}
+	if scope, ok := token.Extra("scope").(string); ok && scope != "" {
+		a.Scopes = strings.Fields(strings.Replace(scope, ",", " ", -1))
+	}
+	ctx, cancel = outboundContext(r.Context(), apiTimeout)
+	defer cancel()
+	client, err := a.client(ctx)
+	if err != nil {
+		fail(nil, errCallbackInternal, err)
+		return
+	}
+	if a.Identity, err = p.Identify(ctx, client); err != nil {
+		fail(nil, errCallbackOutage, err)
+		return
+	}
+	if err := accessRules.check(client, a); err != nil {
+		audits.record(r, a, auditEvent{Action: "login", Target: p.Name, Outcome: auditDenied, Detail: err.Error()})
+		denyAccess(w, a, err)
+		return
+	}
+	a.CheckedAt = time.Now()
+	if err := regenerateSession(session); err != nil {
+		fail(a, errCallbackInternal, err)
+		return
+	}
+	addAccount(session, a)
+	if _, ok := session.Values["created"]; !ok {
+		session.Values["created"] = time.Now()
+	}
+	startSession(session, time.Now())
+	next := takeReturnTo(session, "/user")
+	if err := session.Save(r, w); err != nil {
+		fail(a, errCallbackInternal, err)
+		return
+	}
+	if users != nil && a.Provider == "heroku" {
+		if err := users.saveLogin(a); err != nil {
+			log.Printf("storing user %s: %v", a.Identity.ID, err)
+		}
+	}
+	audits.record(r, a, auditEvent{Action: "login", Target: p.Name, Outcome: auditSuccess})
+	http.Redirect(w, r, next, http.StatusFound)
+}
+
+func handleUser(w http.ResponseWriter, r *http.Request, s *sessions.Session, a *account) {
+	p, ok := lookupProvider(a.Provider)
 	if !ok {
-		http.Error(w, "Unable to assert token", http.StatusInternalServerError)
+		http.Error(w, "Unknown provider", http.StatusInternalServerError)
 		return
 	}
-	client := oauthConfig.Client(context.Background(), token)
-	resp, err := client.Get("https://api.heroku.com/account")
+	ctx, cancel := outboundContext(r.Context(), apiTimeout)
+	defer cancel()
+	client, err := a.client(ctx)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	defer resp.Body.Close()
-	d := json.NewDecoder(resp.Body)
-	var account struct { // See https://devcenter.heroku.com/articles/platform-api-reference#account
-		Email string `json:"email"`
+	var profile *herokuAccount
+	var email string
+	if a.Provider == "heroku" {
+		profile = &herokuAccount{}
+		err = herokuGet(client, "/account", profile)
+		email = profile.Email
+	} else {
+		var id identity
+		id, err = p.Identify(ctx, client)
+		email = id.Email
+	}
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+	fmt.Fprint(w, `<html><body>`)
+	writeAccountBar(w, s, a)
+	fmt.Fprintf(w, `<h1><img src="%s" alt="" width="40" height="40"> Hello %s</h1>`, gravatarURL(email), html.EscapeString(email))
+	if profile != nil {
+		writeProfile(w, s, a, profile)
+		writeJobFailures(w, a)
+		fmt.Fprint(w, `<p><a href="/teams">Teams</a> | <a href="/enterprise">Enterprise accounts</a> | <a href="/jobs">Scheduled jobs</a></p>`)
 	}
-	if err := d.Decode(&account); err != nil {
+	fmt.Fprint(w, `<p><a href="/session">Session details</a> | <a href="/logout">Sign out</a></p></body></html>`)
+}
+
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+	session, err := loadSession(r)
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	fmt.Fprintf(w, `<html><body><h1>Hello %s</h1></body></html>`, account.Email)
+	for _, a := range sessionAccounts(session) {
+		audits.record(r, a, auditEvent{Action: "logout", Target: a.Provider, Outcome: auditSuccess})
+	}
+	endSession(session)
+	session.Values = map[interface{}]interface{}{}
+	session.Options.MaxAge = -1
+	if err := session.Save(r, w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+func routes() http.Handler {
+	return gcontext.ClearHandler(cookieAttributes(reencodeSessions(sessionTimeouts(newRoutes()))))
+}
+
+func newRoutes() *router {
+	rt := newRouter()
+	rt.handleFunc("GET", "/", handleRoot)
+	rt.handleFunc("GET", "/auth/{provider}", withProvider(handleAuth))
+	rt.handleFunc("GET", "/auth/{provider}/callback", withProvider(handleAuthCallback))
+	rt.handleFunc("GET", "/user", withAccount(handleUser))
+	rt.handleFunc("POST", "/user", withAccount(handleProfileUpdate), withCSRF)
+	rt.handleFunc("GET", "/accounts", withAccount(handleAccounts))
+	rt.handleFunc("POST", "/accounts/switch", handleAccountSwitch, withCSRF)
+	rt.handleFunc("POST", "/accounts/remove", handleAccountRemove, withCSRF)
+	rt.handleFunc("GET", "/teams", withAccount(handleTeams))
+	rt.handleFunc("GET", "/teams/{team}", withAccount(handleTeams))
+	rt.handleFunc("GET", "/enterprise", withAccount(handleEnterprise))
+	rt.handleFunc("GET", "/enterprise/{id}", withAccount(handleEnterprise))
+	rt.handleFunc("GET", "/session", withAccount(handleSession))
+	rt.handleFunc("GET", "/jobs", withAccount(handleJobs))
+	rt.handleFunc("POST", "/jobs", withAccount(handleJobCreate), withCSRF)
+	rt.handleFunc("POST", "/jobs/{id}/delete", withAccount(handleJobDelete), withCSRF)
+	rt.handleFunc("GET", "/apps/{app}/webhooks", withAccount(handleAppWebhooks))
+	rt.handleFunc("POST", "/apps/{app}/webhooks", withAccount(handleAppWebhooks), withCSRF)
+	rt.handleFunc("POST", "/apps/{app}/webhooks/{id}/delete", withAccount(handleAppWebhooks), withCSRF)
+	rt.handleFunc("POST", "/webhooks/heroku", handleWebhookReceive)
+	rt.handleFunc("POST", "/sso/login", handleSSOLogin)
+	rt.handleFunc("GET", "/sso/resource", handleSSOResource)
+	rt.handleFunc("POST", "/heroku/resources", handleProvision, addonAuth)
+	rt.handleFunc("PUT", "/heroku/resources/{id}", handlePlanChange, addonAuth)
+	rt.handleFunc("DELETE", "/heroku/resources/{id}", handleDeprovision, addonAuth)
+	rt.handleFunc("GET", "/logout", handleLogout)
+	rt.handleFunc("POST", "/logout", handleLogout, withCSRF)
+	rt.handleFunc("GET", "/admin/audit", withAdmin(handleAdminAudit))
+	rt.handleFunc("GET", "/debug/vars", withAdmin(handleDebugVars))
+	rt.handleFunc("GET", "/.well-known/jwks.json", handleJWKS)
+	rt.handleFunc("POST", "/token", withAccount(handleJWT), withCSRF)
+	if mockServer != nil {
+		rt.handleFunc("GET", "/mock/authorize", mockServer.handleAuthorize)
+		rt.handleFunc("POST", "/mock/authorize", mockServer.handleAuthorize)
+	}
+	return rt
+}
+
+// handleDebugVars serves the expvar metrics to administrators.
+func handleDebugVars(w http.ResponseWriter, r *http.Request, s *sessions.Session, a *account) {
+	expvar.Handler().ServeHTTP(w, r)
 }
 
 func main() {
-	http.HandleFunc("/", handleRoot)
-	http.HandleFunc("/auth/heroku", handleAuth)
-	http.HandleFunc("/auth/heroku/callback", handleAuthCallback)
-	http.HandleFunc("/user", handleUser)
-	http.ListenAndServe(":"+os.Getenv("PORT"), nil)
+	if err := checkDevMode(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if ok, err := runCommand(os.Args[1:]); ok {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if cookieKeysErr != nil {
+		log.Fatalf("COOKIE_KEYS: %v", cookieKeysErr)
+	}
+	if addonPassword != "" && resources.sealer == nil {
+		log.Fatal("RESOURCE_STORE_KEY must be set to store add-on tokens")
+	}
+	for _, line := range newRoutes().table() {
+		log.Println("route", line)
+	}
+	if schedulerMode == "web" && schedulerDyno(getenv("DYNO"), "web") {
+		go newScheduler().start(context.Background())
+	}
+	addr := ":" + getenv("PORT")
+	if devMode {
+		printConfig(os.Stderr)
+		addr = "localhost:" + getenvDefault("PORT", "5000")
+	}
+	http.ListenAndServe(addr, routes())
 }
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// testApp is the app served over TLS and wired to a fakeHeroku, with a
+// browser-like client that keeps cookies between requests.
+type testApp struct {
+	*httptest.Server
+	heroku *fakeHeroku
+	client *http.Client
+}
+
+func newTestApp(t *testing.T) *testApp {
+	heroku := newFakeHeroku()
+	app := httptest.NewTLSServer(routes())
+
+	savedStore, savedConfig, savedAPIURL, savedAudits := store, *oauthConfig, herokuAPIURL, audits
+	t.Cleanup(func() {
+		app.Close()
+		heroku.Close()
+		store, *oauthConfig, herokuAPIURL, audits = savedStore, savedConfig, savedAPIURL, savedAudits
+	})
+
+	audits = &auditLog{sink: ioutil.Discard, max: 100}
+
+	store = sessions.NewCookieStore(securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(16))
+	store.MaxAge(int(sessionLifetime() / time.Second))
+	configureCookies(store.Options)
+	oauthConfig.Endpoint.AuthURL = heroku.URL + "/oauth/authorize"
+	oauthConfig.Endpoint.TokenURL = heroku.URL + "/oauth/token"
+	oauthConfig.ClientID = heroku.ClientID
+	oauthConfig.ClientSecret = heroku.ClientSecret
+	oauthConfig.RedirectURL = app.URL + "/auth/heroku/callback"
+	herokuAPIURL = heroku.URL
+
+	client := app.Client()
+	client.Jar, _ = cookiejar.New(nil)
+	return &testApp{Server: app, heroku: heroku, client: client}
+}
+
+// get fetches path from the app, following redirects, and returns the final
+// response with its body.
+func (a *testApp) get(t *testing.T, path string) (*http.Response, string) {
+	t.Helper()
+	resp, err := a.client.Get(a.URL + path)
+	if err != nil {
+		t.Fatalf("GET %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading %s: %v", path, err)
+	}
+	return resp, string(body)
+}
+
+func (a *testApp) login(t *testing.T) {
+	t.Helper()
+	resp, body := a.get(t, "/auth/heroku")
+	if resp.StatusCode != http.StatusOK || resp.Request.URL.Path != "/user" {
+		t.Fatalf("login ended at %s with %d: %s", resp.Request.URL, resp.StatusCode, body)
+	}
+}
+
+// csrfToken returns the CSRF token of the client's session.
+func (a *testApp) csrfToken(t *testing.T) string {
+	t.Helper()
+	_, body := a.get(t, "/session?format=json")
+	var info sessionInfo
+	if err := json.Unmarshal([]byte(body), &info); err != nil || info.CSRFToken == "" {
+		t.Fatalf("no CSRF token in %s: %v", body, err)
+	}
+	return info.CSRFToken
+}
+
+// postForm posts form to path with the session's CSRF token, following
+// redirects.
+func (a *testApp) postForm(t *testing.T, path string, form url.Values) *http.Response {
+	t.Helper()
+	form.Set(csrfField, a.csrfToken(t))
+	resp, err := a.client.PostForm(a.URL+path, form)
+	if err != nil {
+		t.Fatalf("POST %s: %v", path, err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestLoginAndUserPage(t *testing.T) {
+	app := newTestApp(t)
+	app.login(t)
+
+	resp, body := app.get(t, "/user")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /user = %d: %s", resp.StatusCode, body)
+	}
+	if !strings.Contains(body, "Hello user@example.com") {
+		t.Errorf("user page does not greet the user: %s", body)
+	}
+}
+
+func TestUserPageRequiresLogin(t *testing.T) {
+	app := newTestApp(t)
+
+	resp, body := app.get(t, "/user")
+	if resp.Request.URL.Path != "/" || !strings.Contains(body, "Sign in with Heroku") {
+		t.Errorf("GET /user without a session ended at %s: %s", resp.Request.URL, body)
+	}
+}
+
+func TestTokenRefresh(t *testing.T) {
+	app := newTestApp(t)
+	// oauth2 treats tokens as expired 10s early, so this one is usable for
+	// about a second.
+	app.heroku.setExpiresIn(11)
+	app.login(t)
+	if n := app.heroku.refreshCount(); n != 0 {
+		t.Fatalf("refreshed %d times during login, want 0", n)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	app.heroku.setExpiresIn(3600)
+	if resp, body := app.get(t, "/user"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /user after expiry = %d: %s", resp.StatusCode, body)
+	}
+	if n := app.heroku.refreshCount(); n != 1 {
+		t.Fatalf("refreshed %d times after expiry, want 1", n)
+	}
+
+	// The refreshed token must have been saved to the session.
+	if resp, body := app.get(t, "/user"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /user after refresh = %d: %s", resp.StatusCode, body)
+	}
+	if n := app.heroku.refreshCount(); n != 1 {
+		t.Errorf("refreshed %d times in total, want 1", n)
+	}
+}
+
+func TestRefreshFailure(t *testing.T) {
+	app := newTestApp(t)
+	app.heroku.setExpiresIn(11)
+	app.login(t)
+
+	time.Sleep(1100 * time.Millisecond)
+	app.heroku.failWith("refresh", http.StatusServiceUnavailable)
+	if resp, _ := app.get(t, "/user"); resp.StatusCode == http.StatusOK {
+		t.Errorf("GET /user with a failing refresh = %d, want an error", resp.StatusCode)
+	}
+}
+
+func TestLogout(t *testing.T) {
+	app := newTestApp(t)
+	app.login(t)
+
+	resp, body := app.get(t, "/logout")
+	if resp.Request.URL.Path != "/" || !strings.Contains(body, "Sign in with Heroku") {
+		t.Fatalf("logout ended at %s: %s", resp.Request.URL, body)
+	}
+	if resp, _ := app.get(t, "/user"); resp.Request.URL.Path != "/" {
+		t.Errorf("GET /user after logout ended at %s, want /", resp.Request.URL)
+	}
+}
+
+func TestCallbackFailures(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		setup  func(*testApp)
+		status int
+		title  string
+	}{
+		{"access denied", func(a *testApp) { a.heroku.failWith("authorize", http.StatusForbidden) }, http.StatusForbidden, "Access was not granted"},
+		{"token outage", func(a *testApp) { a.heroku.failWith("token", http.StatusServiceUnavailable) }, http.StatusBadGateway, "Sign in is unavailable"},
+		{"bad client", func(a *testApp) { oauthConfig.ClientSecret = "wrong-secret" }, http.StatusInternalServerError, "Sign in is misconfigured"},
+		{"account outage", func(a *testApp) { a.heroku.failWith("account", http.StatusInternalServerError) }, http.StatusBadGateway, "Sign in is unavailable"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+			tt.setup(app)
+
+			resp, body := app.get(t, "/auth/heroku")
+			if resp.StatusCode != tt.status || !strings.Contains(body, tt.title) || !strings.Contains(body, `href="/auth/heroku"`) {
+				t.Errorf("login = %d, want %d with %q and a retry link: %s", resp.StatusCode, tt.status, tt.title, body)
+			}
+			for _, leak := range []string{app.heroku.ClientSecret, "wrong-secret", "Response:", "oauth2:"} {
+				if strings.Contains(body, leak) {
+					t.Errorf("error page leaks %q: %s", leak, body)
+				}
+			}
+			if resp, _ := app.get(t, "/user"); resp.Request.URL.Path != "/" {
+				t.Errorf("GET /user after failed login ended at %s, want /", resp.Request.URL)
+			}
+		})
+	}
+}
+
+// callbackURL starts a sign in with client without following redirects and
+// returns the callback the fake provider sends it back to.
+func (a *testApp) callbackURL(t *testing.T, client *http.Client) *url.URL {
+	t.Helper()
+	noFollow := *client
+	noFollow.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	next := a.URL + "/auth/heroku"
+	for i := 0; i < 2; i++ {
+		resp, err := noFollow.Get(next)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		loc, err := resp.Location()
+		if err != nil {
+			t.Fatalf("GET %s = %d without a redirect", next, resp.StatusCode)
+		}
+		next = loc.String()
+	}
+	u, _ := url.Parse(next)
+	return u
+}
+
+func TestMaxAccounts(t *testing.T) {
+	app := newTestApp(t)
+	var emails []string
+	for i := 0; i <= maxAccounts; i++ {
+		app.heroku.mu.Lock()
+		app.heroku.User.ID = fmt.Sprintf("%08d-89ab-cdef-0123-456789abcdef", i)
+		app.heroku.User.Email = fmt.Sprintf("someone.with.a.long.name-%d@engineering.example-corporation.com", i)
+		app.heroku.User.Name = fmt.Sprintf("Someone With A Long Name %d", i)
+		emails = append(emails, app.heroku.User.Email)
+		app.heroku.mu.Unlock()
+		app.login(t)
+	}
+
+	// The session keeps the newest accounts, all within the cookie limit.
+	resp, body := app.get(t, "/accounts")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /accounts = %d: %s", resp.StatusCode, body)
+	}
+	for i, email := range emails {
+		if want := i > 0; strings.Contains(body, email) != want {
+			t.Errorf("accounts page lists %s = %v, want %v", email, !want, want)
+		}
+	}
+}
+
+func TestCSRF(t *testing.T) {
+	app := newTestApp(t)
+	oauthConfig.Scopes = []string{"identity", "read", "write"}
+	app.login(t)
+
+	for _, token := range []string{"", "forged"} {
+		resp, err := app.client.PostForm(app.URL+"/user", url.Values{"name": {"Forged"}, csrfField: {token}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("POST /user with CSRF token %q = %d, want %d", token, resp.StatusCode, http.StatusForbidden)
+		}
+	}
+	if app.heroku.User.Name == "Forged" {
+		t.Fatal("forged request changed the account")
+	}
+	if _, body := app.get(t, "/user"); !strings.Contains(body, `name="csrf_token" value="`+app.csrfToken(t)+`"`) {
+		t.Errorf("settings form does not carry the CSRF token: %s", body)
+	}
+	if resp := app.postForm(t, "/user", url.Values{"name": {"Changed"}}); resp.StatusCode != http.StatusOK {
+		t.Errorf("POST /user with the CSRF token = %d", resp.StatusCode)
+	}
+}
+
+func TestExpiredCode(t *testing.T) {
+	app := newTestApp(t)
+
+	state := app.callbackURL(t, app.client).Query().Get("state")
+	resp, body := app.get(t, "/auth/heroku/callback?code=used-code&state="+state)
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(body, "invalid or has expired") {
+		t.Errorf("callback with an unknown code = %d: %s", resp.StatusCode, body)
+	}
+}
+
+func TestInvalidState(t *testing.T) {
+	app := newTestApp(t)
+
+	resp, _ := app.get(t, "/auth/heroku/callback?state=bogus&code=x")
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("callback with bad state = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+
+	// A state is only good once.
+	callback := app.callbackURL(t, app.client)
+	if resp, _ := app.get(t, callback.RequestURI()); resp.Request.URL.Path != "/user" {
+		t.Fatalf("callback ended at %s", resp.Request.URL.Path)
+	}
+	if resp, _ := app.get(t, callback.RequestURI()); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("replayed callback = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestLoginCSRF(t *testing.T) {
+	app := newTestApp(t)
+	app.login(t)
+
+	// An attacker's own callback, complete with a state their browser was
+	// given, must not sign the victim in.
+	attacker := *app.client
+	attacker.Jar, _ = cookiejar.New(nil)
+	forged := app.callbackURL(t, &attacker)
+	resp, _ := app.get(t, forged.RequestURI())
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("attacker's callback in the victim's browser = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+	// Nor without any state at all.
+	if resp, _ := app.get(t, "/auth/heroku/callback?state=&code="+forged.Query().Get("code")); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("callback without state = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestSessionPage(t *testing.T) {
+	app := newTestApp(t)
+	app.login(t)
+
+	resp, body := app.get(t, "/session?format=json")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /session = %d: %s", resp.StatusCode, body)
+	}
+	var info sessionInfo
+	if err := json.Unmarshal([]byte(body), &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.UserID != app.heroku.User.ID || !info.HasRefreshToken || info.TokenExpiresIn <= 0 || info.SessionCreated == nil {
+		t.Errorf("unexpected session info: %s", body)
+	}
+	for _, page := range []string{"/session", "/session?format=json"} {
+		_, body := app.get(t, page)
+		if strings.Contains(body, "access-") || strings.Contains(body, "refresh-") {
+			t.Errorf("%s exposes a token: %s", page, body)
+		}
+	}
+}
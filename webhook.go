@@ -0,0 +1,218 @@
+package main
+
+import (
+	"container/list"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+var webhookSecret = getenv("WEBHOOK_SECRET")
+
+// webhookEvent is an app webhook delivery. See
+// https://devcenter.heroku.com/articles/app-webhooks#receiving-webhooks
+type webhookEvent struct {
+	ID        string    `json:"id"`
+	Action    string    `json:"action"`
+	Resource  string    `json:"resource"`
+	CreatedAt time.Time `json:"created_at"`
+	Data      struct {
+		App struct {
+			Name string `json:"name"`
+		} `json:"app"`
+	} `json:"data"`
+	Metadata struct {
+		Delivery struct {
+			ID string `json:"id"`
+		} `json:"delivery"`
+		Event struct {
+			Include string `json:"include"`
+		} `json:"event"`
+	} `json:"webhook_metadata"`
+}
+
+// webhookEvents keeps recent deliveries per app and remembers delivery IDs
+// so retried deliveries are only stored once.
+type webhookEvents struct {
+	mu        sync.Mutex
+	perApp    int
+	byApp     map[string][]webhookEvent
+	seen      map[string]*list.Element
+	seenOrder *list.List
+	maxSeen   int
+}
+
+var webhooks = newWebhookEvents(50, 10000)
+
+func newWebhookEvents(perApp, maxSeen int) *webhookEvents {
+	return &webhookEvents{
+		perApp:    perApp,
+		byApp:     map[string][]webhookEvent{},
+		seen:      map[string]*list.Element{},
+		seenOrder: list.New(),
+		maxSeen:   maxSeen,
+	}
+}
+
+// add stores e, reporting false if its delivery was already seen.
+func (s *webhookEvents) add(e webhookEvent) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := e.Metadata.Delivery.ID
+	if _, ok := s.seen[id]; ok {
+		return false
+	}
+	s.seen[id] = s.seenOrder.PushBack(id)
+	if s.seenOrder.Len() > s.maxSeen {
+		delete(s.seen, s.seenOrder.Remove(s.seenOrder.Front()).(string))
+	}
+	app := e.Data.App.Name
+	events := append(s.byApp[app], e)
+	if len(events) > s.perApp {
+		events = events[len(events)-s.perApp:]
+	}
+	s.byApp[app] = events
+	return true
+}
+
+// recent returns app's stored events, newest first.
+func (s *webhookEvents) recent(app string) []webhookEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	events := s.byApp[app]
+	out := make([]webhookEvent, len(events))
+	for i, e := range events {
+		out[len(events)-1-i] = e
+	}
+	return out
+}
+
+func validWebhookSignature(secret string, body []byte, signature string) bool {
+	got, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+func handleWebhookReceive(w http.ResponseWriter, r *http.Request) {
+	if webhookSecret == "" {
+		http.Error(w, "Webhooks are not configured", http.StatusNotFound)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !validWebhookSignature(webhookSecret, body, r.Header.Get("Heroku-Webhook-Hmac-SHA256")) {
+		log.Printf("rejected webhook delivery %s with an invalid signature", r.Header.Get("Heroku-Webhook-Id"))
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+	var e webhookEvent
+	if err := json.Unmarshal(body, &e); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if e.Metadata.Delivery.ID == "" {
+		e.Metadata.Delivery.ID = r.Header.Get("Heroku-Webhook-Id")
+	}
+	if e.Metadata.Delivery.ID == "" {
+		e.Metadata.Delivery.ID = e.ID
+	}
+	if !webhooks.add(e) {
+		log.Printf("ignored duplicate webhook delivery %s", e.Metadata.Delivery.ID)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// webhookSubscription is an app webhook as returned by the Platform API. See
+// https://devcenter.heroku.com/articles/platform-api-reference#app-webhook
+type webhookSubscription struct {
+	ID      string   `json:"id"`
+	URL     string   `json:"url"`
+	Level   string   `json:"level"`
+	Include []string `json:"include"`
+}
+
+var webhookEntities = []string{"api:release", "api:build", "dyno", "api:formation"}
+
+// handleAppWebhooks serves /apps/{app}/webhooks and the create and delete
+// actions beneath it.
+func handleAppWebhooks(w http.ResponseWriter, r *http.Request, s *sessions.Session, a *account) {
+	app := r.PathValue("app")
+	ctx, cancel := outboundContext(r.Context(), apiTimeout)
+	defer cancel()
+	client, err := herokuClient(ctx, a)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	path := "/apps/" + url.PathEscape(app) + "/webhooks"
+
+	if r.Method == "POST" {
+		r.ParseForm()
+		var action, target string
+		if id := r.PathValue("id"); id != "" {
+			action, target = "webhook.delete", app+"/"+id
+			err = herokuDo(client, "DELETE", path+"/"+url.PathEscape(id), nil, nil)
+		} else if webhookSecret == "" {
+			// The receiver rejects every delivery without a secret to check.
+			http.Error(w, "WEBHOOK_SECRET is not set, so deliveries could not be verified", http.StatusServiceUnavailable)
+			return
+		} else {
+			action, target = "webhook.create", app
+			err = herokuDo(client, "POST", path, map[string]interface{}{
+				"url":     appURL + "/webhooks/heroku",
+				"secret":  webhookSecret,
+				"level":   "notify",
+				"include": r.Form["include"],
+			}, nil)
+		}
+		if err != nil {
+			audits.record(r, a, auditEvent{Action: action, Target: target, Outcome: auditFailure, Detail: err.Error()})
+			apiError(w, err)
+			return
+		}
+		audits.record(r, a, auditEvent{Action: action, Target: target, Outcome: auditSuccess})
+		http.Redirect(w, r, path, http.StatusFound)
+		return
+	}
+	var subs []webhookSubscription
+	if err := herokuGet(client, path, &subs); err != nil {
+		apiError(w, err)
+		return
+	}
+	fmt.Fprint(w, `<html><body>`)
+	writeAccountBar(w, s, a)
+	fmt.Fprintf(w, `<h1>Webhooks for %s</h1><h2>Subscriptions</h2><ul>`, html.EscapeString(app))
+	for _, sub := range subs {
+		fmt.Fprintf(w, `<li>%s (%s) <form method="post" action="%s/%s/delete" style="display:inline">%s<button>Delete</button></form></li>`,
+			html.EscapeString(sub.URL), html.EscapeString(strings.Join(sub.Include, ", ")), html.EscapeString(path), url.PathEscape(sub.ID), csrfInput(s))
+	}
+	fmt.Fprintf(w, `</ul><form method="post" action="%s">%s`, html.EscapeString(path), csrfInput(s))
+	for _, e := range webhookEntities {
+		fmt.Fprintf(w, `<label><input type="checkbox" name="include" value="%[1]s" checked> %[1]s</label> `, e)
+	}
+	fmt.Fprint(w, `<button>Subscribe this app</button></form><h2>Recent events</h2><table><tr><th>Received</th><th>Event</th><th>Action</th><th>Delivery</th></tr>`)
+	for _, e := range webhooks.recent(app) {
+		fmt.Fprintf(w, `<tr><td>%s</td><td>%s</td><td>%s</td><td>%s</td></tr>`,
+			e.CreatedAt.Format(time.RFC3339), html.EscapeString(e.Metadata.Event.Include), html.EscapeString(e.Action), html.EscapeString(e.Metadata.Delivery.ID))
+	}
+	fmt.Fprint(w, `</table></body></html>`)
+}
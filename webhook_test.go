@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func deliverWebhook(t *testing.T, body, signature string) int {
+	req := httptest.NewRequest("POST", "/webhooks/heroku", strings.NewReader(body))
+	req.Header.Set("Heroku-Webhook-Hmac-SHA256", signature)
+	rec := httptest.NewRecorder()
+	handleWebhookReceive(rec, req)
+	return rec.Code
+}
+
+func signWebhook(secret, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestWebhookReceive(t *testing.T) {
+	savedSecret, savedEvents := webhookSecret, webhooks
+	defer func() { webhookSecret, webhooks = savedSecret, savedEvents }()
+	webhookSecret = "s3cret"
+	webhooks = newWebhookEvents(10, 10)
+
+	body := `{"id":"evt-1","action":"create","resource":"release","data":{"app":{"name":"example"}},` +
+		`"webhook_metadata":{"delivery":{"id":"delivery-1"},"event":{"include":"api:release"}}}`
+
+	if code := deliverWebhook(t, body, signWebhook("wrong", body)); code != http.StatusUnauthorized {
+		t.Errorf("delivery with a bad signature = %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := deliverWebhook(t, body, "not base64!"); code != http.StatusUnauthorized {
+		t.Errorf("delivery with a malformed signature = %d, want %d", code, http.StatusUnauthorized)
+	}
+	if n := len(webhooks.recent("example")); n != 0 {
+		t.Fatalf("stored %d events from rejected deliveries", n)
+	}
+
+	for i := 0; i < 2; i++ {
+		if code := deliverWebhook(t, body, signWebhook("s3cret", body)); code != http.StatusOK {
+			t.Errorf("signed delivery = %d, want %d", code, http.StatusOK)
+		}
+	}
+	events := webhooks.recent("example")
+	if len(events) != 1 {
+		t.Fatalf("stored %d events, want the duplicate delivery dropped", len(events))
+	}
+	if e := events[0]; e.Resource != "release" || e.Metadata.Event.Include != "api:release" {
+		t.Errorf("stored %+v", e)
+	}
+}
+
+func TestWebhookEventsLimits(t *testing.T) {
+	s := newWebhookEvents(2, 3)
+	for _, id := range []string{"a", "b", "c", "d"} {
+		var e webhookEvent
+		e.ID = id
+		e.Data.App.Name = "app"
+		e.Metadata.Delivery.ID = id
+		s.add(e)
+	}
+	if events := s.recent("app"); len(events) != 2 || events[0].ID != "d" || events[1].ID != "c" {
+		t.Errorf("recent = %+v, want d and c", events)
+	}
+	if len(s.seen) != 3 {
+		t.Errorf("remembered %d deliveries, want 3", len(s.seen))
+	}
+}
+
+func TestWebhookSubscribeNeedsSecret(t *testing.T) {
+	saved := webhookSecret
+	defer func() { webhookSecret = saved }()
+	app := newTestApp(t)
+	app.login(t)
+
+	webhookSecret = ""
+	if resp := app.postForm(t, "/apps/example/webhooks", url.Values{"include": {"api:release"}}); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("subscribe without WEBHOOK_SECRET = %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+	if calls := app.heroku.calls(); len(calls) != 0 {
+		t.Errorf("subscribed anyway: %v", calls)
+	}
+
+	webhookSecret = "s3cret"
+	app.postForm(t, "/apps/example/webhooks", url.Values{"include": {"api:release"}})
+	if calls := app.heroku.calls(); len(calls) == 0 || calls[0] != "POST /apps/example/webhooks" {
+		t.Errorf("app calls = %v, want the subscription", calls)
+	}
+}